@@ -4,15 +4,19 @@
 package main
 
 import (
+	"bufio"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 )
 import (
 	"github.com/as/mute"
@@ -24,11 +28,20 @@ const (
 )
 
 var args struct {
-	h, q, v bool
-	k       bool
-	m       bool
-	a       int
-	n       string
+	h, q, v  bool
+	k        bool
+	m        bool
+	f        bool
+	scan     bool
+	a        int
+	n        string
+	ca       string
+	expires  string
+	name     string
+	starttls string
+	crl      string
+	ocsp     string
+	revoke   bool
 }
 
 func init() {
@@ -38,9 +51,20 @@ func init() {
 	f.BoolVar(&args.v, "v", false, "")
 	f.BoolVar(&args.k, "k", false, "")
 	f.BoolVar(&args.m, "m", false, "")
+	f.BoolVar(&args.f, "f", false, "")
+	f.BoolVar(&args.scan, "scan", false, "")
 	f.IntVar(&args.a, "a", 4096, "")
 	f.StringVar(&args.n, "n", "tcp4", "")
+	f.StringVar(&args.ca, "ca", "", "")
+	f.StringVar(&args.expires, "expires", "", "")
+	f.StringVar(&args.name, "name", "", "")
+	f.StringVar(&args.starttls, "starttls", "", "")
+	f.StringVar(&args.crl, "crl", "", "")
+	f.StringVar(&args.ocsp, "ocsp", "", "")
+	f.BoolVar(&args.revoke, "revoke", false, "")
+}
 
+func argparse() {
 	err := mute.Parse(f, os.Args[1:])
 	if err != nil {
 		printerr(err)
@@ -82,7 +106,10 @@ func (e ExtKeyUsage) MarshalJSON() ([]byte, error)        { return unfuncname(e)
 type Suite uint16
 
 func (s Suite) String() string {
-	return suiteString[s]
+	if name, ok := suiteString[s]; ok {
+		return name
+	}
+	return tls.CipherSuiteName(uint16(s))
 }
 
 const (
@@ -101,6 +128,18 @@ const (
 	ECDHE_ECDSA_AES_128_GCM_SHA256 Suite = 0xc02b
 	ECDHE_RSA_AES_256_GCM_SHA384   Suite = 0xc030
 	ECDHE_ECDSA_AES_256_GCM_SHA384 Suite = 0xc02c
+	RSA_AES_128_CBC_SHA256         Suite = 0x003c
+	RSA_AES_128_GCM_SHA256         Suite = 0x009c
+	RSA_AES_256_GCM_SHA384         Suite = 0x009d
+	ECDHE_ECDSA_AES_128_CBC_SHA256 Suite = 0xc023
+	ECDHE_RSA_AES_128_CBC_SHA256   Suite = 0xc027
+	ECDHE_RSA_CHACHA20_POLY1305    Suite = 0xcca8
+	ECDHE_ECDSA_CHACHA20_POLY1305  Suite = 0xcca9
+
+	// TLS 1.3 suites name only the aead and hash
+	AES_128_GCM_SHA256       Suite = 0x1301
+	AES_256_GCM_SHA384       Suite = 0x1302
+	CHACHA20_POLY1305_SHA256 Suite = 0x1303
 
 	// FALLBACK_SCSV isn't a standard cipher suite but an indicator
 	// that the client is doing version fallback. See
@@ -124,6 +163,16 @@ var suiteString = map[Suite]string{
 	0xc02b: "ECDHE/ECDSA/AES/GCM/128/SHA256",
 	0xc030: "ECDHE/RSA/AES/GCM/256/SHA384",
 	0xc02c: "ECDHE/ECDSA/AES/GCM/256/SHA384",
+	0x003c: "RSA/AES/CBC/128/SHA256",
+	0x009c: "RSA/AES/GCM/128/SHA256",
+	0x009d: "RSA/AES/GCM/256/SHA384",
+	0xc023: "ECDHE/ECDSA/AES/CBC/128/SHA256",
+	0xc027: "ECDHE/RSA/AES/CBC/128/SHA256",
+	0xcca8: "ECDHE/RSA/CHACHA20/POLY1305/SHA256",
+	0xcca9: "ECDHE/ECDSA/CHACHA20/POLY1305/SHA256",
+	0x1301: "AES/GCM/128/SHA256",
+	0x1302: "AES/GCM/256/SHA384",
+	0x1303: "CHACHA20/POLY1305/SHA256",
 	0x5600: "FALLBACK/SCSV",
 }
 
@@ -183,15 +232,50 @@ const (
 const form = "% +v\n"
 
 func main() {
+	argparse()
 	nargs := len(f.Args())
-	if args.h || args.q || nargs == 0 {
+	if args.h || args.q || nargs == 0 && !args.f {
 		usage()
 		os.Exit(1)
 	}
 
-	srv := f.Args()[0]
+	var err error
+	if args.expires != "" {
+		within, err = parsedays(args.expires)
+		sysfatal(err)
+	}
+	var cas []*x509.Certificate
+	cas, pool, err = roots(args.ca)
+	sysfatal(err)
+	revocation = &Revocation{OCSP: args.ocsp, AIA: args.revoke, Roots: cas}
+	if args.crl != "" {
+		crl, err := loadCRL(args.crl)
+		sysfatal(err)
+		revocation.CRLs = append(revocation.CRLs, crl)
+	}
+	if _, ok := upgrades[args.starttls]; args.starttls != "" && !ok {
+		sysfatal(fmt.Errorf("starttls: unknown protocol: %s", args.starttls))
+	}
+
+	if args.f {
+		files()
+		return
+	}
+
+	srv := defaultport(f.Args()[0], args.starttls)
+	name := args.name
+	if name == "" {
+		name, _, _ = net.SplitHostPort(srv)
+	}
+
+	if args.scan {
+		r, err := Scan(srv, name)
+		sysfatal(err)
+		sysfatal(dump(os.Stdout, r))
+		os.Exit(r.Exit())
+	}
 
-	fd, err := tls.Dial(args.n, srv, &tls.Config{InsecureSkipVerify: true})
+	fd, err := dial(srv, &tls.Config{InsecureSkipVerify: true, ServerName: name})
 	if err != nil {
 		printerr(err)
 		if fd != nil {
@@ -199,23 +283,100 @@ func main() {
 		}
 		os.Exit(1)
 	}
-	for _, v := range fd.ConnectionState().PeerCertificates {
-		c := &Cert{Certificate: *v}
-		c.KeyUsage = KeyUsage(v.KeyUsage)
-		c.SignatureAlgorithm = SignatureAlgorithm(v.SignatureAlgorithm)
-		c.PublicKeyAlgorithm = PublicKeyAlgorithm(v.PublicKeyAlgorithm)
-		c.PublicKeyAlgorithm = PublicKeyAlgorithm(v.PublicKeyAlgorithm)
-		c.Subject = Name{Name: v.Subject}
-		c.Issuer = Name{Name: v.Issuer}
-		data, err := json.MarshalIndent(c, "", "   ")
-		if err != nil {
-			printerr(err)
-			os.Exit(1)
+	chain := fd.ConnectionState().PeerCertificates
+	for _, v := range chain {
+		sysfatal(dump(os.Stdout, NewCert(v)))
+	}
+	r := Verify(chain, name, pool, time.Now(), within)
+	revocation.Check(r, chain, time.Now())
+	sysfatal(dump(os.Stdout, r))
+	os.Exit(r.Exit())
+}
+
+var (
+	pool       *x509.CertPool
+	within     time.Duration
+	revocation *Revocation
+)
+
+// files prints the contents of each file named on the command
+// line, or standard input. A name of "-" reads a list of names
+// from standard input.
+func files() {
+	names := f.Args()
+	if len(names) == 0 {
+		os.Exit(file("/dev/stdin", os.Stdin))
+	}
+	exit := ExitOK
+	for _, name := range names {
+		if name != "-" {
+			exit = worst(exit, openfile(name))
+			continue
+		}
+		sc := bufio.NewScanner(os.Stdin)
+		for sc.Scan() {
+			exit = worst(exit, openfile(sc.Text()))
+		}
+		if err := sc.Err(); err != nil {
+			printerr("-:", err)
+			exit = worst(exit, ExitError)
 		}
-		fmt.Print(string(data))
 	}
-	sysfatal(err)
+	os.Exit(exit)
+}
 
+func openfile(name string) int {
+	fd, err := os.Open(name)
+	if err != nil {
+		printerr(err)
+		return ExitError
+	}
+	defer fd.Close()
+	return file(name, fd)
+}
+
+// file prints the contents of the named file read from in and
+// returns its exit status
+func file(name string, in io.Reader) int {
+	exit := ExitOK
+	b, err := ReadBundle(in)
+	if err != nil {
+		printerr(name+":", err)
+		exit = ExitError
+	}
+	if b == nil {
+		return exit
+	}
+	for _, v := range b.Values() {
+		sysfatal(dump(os.Stdout, v))
+	}
+	if len(b.Certs) == 0 {
+		return exit
+	}
+	r := Verify(b.Certs, args.name, pool, time.Now(), within)
+	revocation.Check(r, b.Certs, time.Now())
+	r.File = name
+	sysfatal(dump(os.Stdout, r))
+	return worst(exit, r.Exit())
+}
+
+func dump(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "   ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(w, string(data))
+	return err
+}
+
+func NewCert(v *x509.Certificate) *Cert {
+	c := &Cert{Certificate: *v}
+	c.KeyUsage = KeyUsage(v.KeyUsage)
+	c.SignatureAlgorithm = SignatureAlgorithm(v.SignatureAlgorithm)
+	c.PublicKeyAlgorithm = PublicKeyAlgorithm(v.PublicKeyAlgorithm)
+	c.Subject = Name{Name: v.Subject}
+	c.Issuer = Name{Name: v.Issuer}
+	return c
 }
 
 type Mask *int
@@ -286,12 +447,14 @@ func printdebug(v ...interface{}) {
 }
 
 func usage() {
-	fmt.Println(`
+	fmt.Print(`
 NAME
 	cert - certificates to your gaping maw
 
 SYNOPSIS
-	cert host:port
+	cert [-ca file] [-expires 30d] [-name host] [-starttls proto] host[:port]
+	cert [-ca file] [-expires 30d] [-name host] -f [file ...]
+	cert -scan [-name host] [-starttls proto] host[:port]
 
 DESCRIPTION
 	Given host and port, cert prints the certificate(s)
@@ -300,8 +463,92 @@ DESCRIPTION
 	A certificate with the same Subject and Issuer is
 	self-signed.
 
+	After the certificates, cert prints a report verifying
+	the chain. Each problem names the certificate by its
+	index in the chain, leaf first, and cert exits with the
+	status of the most severe, in this order:
+
+	0  verified
+	1  error reading or connecting, or checking revocation
+	9  revoked
+	2  untrusted: chain doesn't lead to a trusted root
+	3  order: chain out of order, or a bad signature
+	4  expired, or not valid yet
+	5  hostname doesn't match the leaf
+	6  usage: key usage doesn't permit the role. The leaf
+	   must permit server auth only when a name is checked
+	7  expiring within -expires
+	8  scan: the server accepts a weak suite
+
+OPTIONS
+	-ca file      Trust the certificates in file instead of the
+	              system roots
+	-expires d    Report certificates that expire within d. A
+	              suffix of d counts days, otherwise a go duration
+	-name host    Check the leaf against host. Defaults to the
+	              host being dialed; with -f, there is no check
+	-crl src      Check the chain against the crl in file or http
+	              url src
+	-ocsp url     Ask the ocsp responder at url about the leaf
+	-revoke       Check each certificate against the crls and ocsp
+	              responders it names. A source that can't be
+	              checked is an error.
+	-scan         Instead of printing certificates, handshake once
+	              per tls version and cipher suite and report which
+	              the server accepts, and the order it picks them in.
+	              Suites using rc4, 3des, null or export ciphers, cbc
+	              with sha1, or rsa key exchange are flagged weak.
+	              Tls1.3 suites can't be chosen by the client, so only
+	              the one the server picks is reported. Only suites
+	              go's crypto/tls implements are tried: a server may
+	              also accept dhe, dss, camellia, aria or psk suites
+	              that aren't listed.
+	-starttls p   Speak protocol p in plaintext and ask the server
+	              to begin tls before the handshake. The port
+	              defaults to the protocol's port.
+
+	              smtp      25    EHLO, STARTTLS
+	              imap      143   STARTTLS
+	              pop3      110   STLS
+	              ftp       21    AUTH TLS
+	              ldap      389   StartTLS extended operation
+	              postgres  5432  SSLRequest
+	-f    Read certificates, chains, certificate requests and
+	      revocation lists from files instead of a host. PEM
+	      and DER are detected. With no files, read standard
+	      input. The file "-" reads a list of file names from
+	      standard input.
+
 EXAMPLE
 	cert google.com:443
 	cert yourpc:3389
+
+	Audit the certificate made by gen, and every bundle
+	under /etc/ssl.
+
+	cert -f cert.pem
+	walk /etc/ssl | cert -f -
+
+	Check a mail server that upgrades to tls.
+
+	cert -starttls smtp mail.example.com
+	cert -starttls imap mail.example.com:143
+
+	Compare the suites of two deployments.
+
+	cert -scan old.example.com:443 > old.json
+	cert -scan new.example.com:443 > new.json
+	diff old.json new.json
+
+	Check revocation against gen's stand-ins.
+
+	gen -issuer int.pem -issuerkey int-key.pem -crl int.crl
+	listen :8080 gen -issuer int.pem -issuerkey int-key.pem -ocsp - &
+	cert -ca root.pem -crl int.crl -f alice.pem
+	cert -ca root.pem -ocsp http://localhost:8080/ -f alice.pem
+
+	Alert from cron when a certificate lapses within 30 days.
+
+	cert -expires 30d example.com:443 >/dev/null || mail ...
 `)
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+// Bundle holds everything found in one file
+type Bundle struct {
+	Certs []*x509.Certificate
+	CSRs  []*x509.CertificateRequest
+	CRLs  []*pkix.CertificateList
+}
+
+// ReadBundle reads certificates, requests and revocation lists
+// from r. PEM input may hold any number of blocks of each kind.
+// DER input holds one request or revocation list, or a sequence
+// of certificates.
+func ReadBundle(r io.Reader) (*Bundle, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bundle{}
+	if !bytes.Contains(data, []byte("-----BEGIN ")) {
+		return b, b.add("", data)
+	}
+	for {
+		var p *pem.Block
+		p, data = pem.Decode(data)
+		if p == nil {
+			break
+		}
+		if err := b.add(p.Type, p.Bytes); err != nil {
+			return b, err
+		}
+	}
+	if b.Len() == 0 {
+		return b, fmt.Errorf("no certificates, requests or revocation lists found")
+	}
+	return b, nil
+}
+
+// Len returns the number of items in the bundle
+func (b *Bundle) Len() int {
+	return len(b.Certs) + len(b.CSRs) + len(b.CRLs)
+}
+
+// add parses one pem block, or der input if typ is empty
+func (b *Bundle) add(typ string, der []byte) error {
+	switch typ {
+	case "CERTIFICATE", "TRUSTED CERTIFICATE":
+		c, err := x509.ParseCertificates(der)
+		b.Certs = append(b.Certs, c...)
+		return err
+	case "CERTIFICATE REQUEST", "NEW CERTIFICATE REQUEST":
+		c, err := x509.ParseCertificateRequest(der)
+		if err == nil {
+			b.CSRs = append(b.CSRs, c)
+		}
+		return err
+	case "X509 CRL":
+		c, err := x509.ParseDERCRL(der)
+		if err == nil {
+			b.CRLs = append(b.CRLs, c)
+		}
+		return err
+	case "":
+		if c, err := x509.ParseCertificates(der); err == nil {
+			b.Certs = append(b.Certs, c...)
+			return nil
+		}
+		if c, err := x509.ParseCertificateRequest(der); err == nil {
+			b.CSRs = append(b.CSRs, c)
+			return nil
+		}
+		if c, err := x509.ParseDERCRL(der); err == nil {
+			b.CRLs = append(b.CRLs, c)
+			return nil
+		}
+		return fmt.Errorf("not a certificate, request or revocation list")
+	}
+	printdebug("skip pem block:", typ)
+	return nil
+}
+
+// Values returns the json form of each item in the bundle
+func (b *Bundle) Values() (v []interface{}) {
+	for _, c := range b.Certs {
+		v = append(v, NewCert(c))
+	}
+	for _, c := range b.CSRs {
+		v = append(v, NewCSR(c))
+	}
+	for _, c := range b.CRLs {
+		v = append(v, NewCRL(c))
+	}
+	return v
+}
+
+type CSR struct {
+	Raw                      Mask `json:",omitempty"`
+	RawTBSCertificateRequest Mask `json:",omitempty"`
+	RawSubjectPublicKeyInfo  Mask `json:",omitempty"`
+	RawSubject               Mask `json:",omitempty"`
+	Attributes               Mask `json:",omitempty"`
+	Extensions               Mask `json:",omitempty"`
+	ExtraExtensions          Mask `json:",omitempty"`
+	Subject                  Name `json:",omitempty"`
+	SignatureAlgorithm       SignatureAlgorithm
+	PublicKeyAlgorithm       PublicKeyAlgorithm
+	x509.CertificateRequest
+}
+
+func NewCSR(v *x509.CertificateRequest) *CSR {
+	c := &CSR{CertificateRequest: *v}
+	c.SignatureAlgorithm = SignatureAlgorithm(v.SignatureAlgorithm)
+	c.PublicKeyAlgorithm = PublicKeyAlgorithm(v.PublicKeyAlgorithm)
+	c.Subject = Name{Name: v.Subject}
+	return c
+}
+
+type CRL struct {
+	Issuer             Name
+	SignatureAlgorithm string
+	ThisUpdate         time.Time
+	NextUpdate         time.Time
+	Expired            bool
+	Revoked            []Revoked
+}
+
+type Revoked struct {
+	SerialNumber   *big.Int
+	RevocationTime time.Time
+}
+
+func NewCRL(v *pkix.CertificateList) *CRL {
+	c := &CRL{
+		SignatureAlgorithm: v.SignatureAlgorithm.Algorithm.String(),
+		ThisUpdate:         v.TBSCertList.ThisUpdate,
+		NextUpdate:         v.TBSCertList.NextUpdate,
+		Expired:            v.HasExpired(time.Now()),
+	}
+	c.Issuer.Name.FillFromRDNSequence(&v.TBSCertList.Issuer)
+	for _, r := range v.TBSCertList.RevokedCertificates {
+		c.Revoked = append(c.Revoked, Revoked{r.SerialNumber, r.RevocationTime})
+	}
+	return c
+}
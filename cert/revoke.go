@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ExitRevoked is the exit status when a certificate is revoked. It
+// takes precedence over every status but ExitError.
+const ExitRevoked = 9
+
+// FetchTimeout limits fetching a crl or asking an ocsp responder
+const FetchTimeout = 30 * time.Second
+
+var client = &http.Client{Timeout: FetchTimeout}
+
+// Revocation checks chains against crls and ocsp responders. Crls
+// come from -crl, and with -revoke, from the distribution points
+// in each certificate. Ocsp responders come from -ocsp for the leaf,
+// and with -revoke, from each certificate.
+type Revocation struct {
+	CRLs  []*pkix.CertificateList
+	OCSP  string
+	AIA   bool
+	Roots []*x509.Certificate
+
+	fetched map[string]*pkix.CertificateList
+}
+
+// Enabled reports whether any revocation source was given
+func (v *Revocation) Enabled() bool {
+	return v != nil && (len(v.CRLs) > 0 || v.OCSP != "" || v.AIA)
+}
+
+// Check adds a problem to the report for each revoked certificate
+// in the chain, for each source that couldn't be checked, and for
+// each -crl that wasn't signed by an issuer in the chain
+func (v *Revocation) Check(r *Report, chain []*x509.Certificate, now time.Time) {
+	if !v.Enabled() {
+		return
+	}
+	used := make([]bool, len(v.CRLs))
+	for i, c := range chain {
+		issuer := v.issuer(chain, i)
+		if issuer == nil {
+			if !bytes.Equal(c.RawIssuer, c.RawSubject) {
+				r.add("revocation", ExitError, i, "can't check: issuer not found")
+			}
+			continue
+		}
+		crls := v.CRLs
+		if v.AIA {
+			for _, url := range c.CRLDistributionPoints {
+				crl, err := v.fetch(url)
+				if err != nil {
+					r.add("revocation", ExitError, i, "crl %s: %s", url, err)
+					continue
+				}
+				crls = append(crls, crl)
+			}
+		}
+		for j, crl := range crls {
+			if issuer.CheckCRLSignature(crl) != nil {
+				continue
+			}
+			if j < len(used) {
+				used[j] = true
+			}
+			if crl.HasExpired(now) {
+				r.add("revocation", ExitError, i, "crl from %s is stale since %s", issuer.Subject, crl.TBSCertList.NextUpdate)
+			}
+			for _, rc := range crl.TBSCertList.RevokedCertificates {
+				if rc.SerialNumber.Cmp(c.SerialNumber) == 0 {
+					r.add("revoked", ExitRevoked, i, "revoked on %s by crl from %s", rc.RevocationTime, issuer.Subject)
+				}
+			}
+		}
+		var responders []string
+		if i == 0 && v.OCSP != "" {
+			responders = append(responders, v.OCSP)
+		} else if v.AIA {
+			responders = c.OCSPServer
+		}
+		for _, url := range responders {
+			resp, err := query(url, c, issuer)
+			switch {
+			case err != nil:
+				r.add("revocation", ExitError, i, "ocsp %s: %s", url, err)
+			case resp.Status == ocsp.Revoked:
+				r.add("revoked", ExitRevoked, i, "revoked on %s (%s) by ocsp %s", resp.RevokedAt, reason(resp.RevocationReason), url)
+			case resp.Status != ocsp.Good:
+				r.add("revocation", ExitError, i, "ocsp %s: status unknown", url)
+			}
+		}
+	}
+	for j, ok := range used {
+		if !ok {
+			r.add("revocation", ExitError, -1, "crl from %s matches no issuer in the chain", v.CRLs[j].TBSCertList.Issuer)
+		}
+	}
+	r.Verified = len(r.Problems) == 0
+}
+
+// issuer returns the certificate that signed chain[i], from the
+// chain or from the -ca roots
+func (v *Revocation) issuer(chain []*x509.Certificate, i int) *x509.Certificate {
+	c := chain[i]
+	candidates := append(append([]*x509.Certificate{}, chain[i+1:]...), v.Roots...)
+	for _, p := range candidates {
+		if bytes.Equal(c.RawIssuer, p.RawSubject) && c.CheckSignatureFrom(p) == nil {
+			return p
+		}
+	}
+	return nil
+}
+
+func (v *Revocation) fetch(url string) (*pkix.CertificateList, error) {
+	if crl, ok := v.fetched[url]; ok {
+		return crl, nil
+	}
+	crl, err := loadCRL(url)
+	if err != nil {
+		return nil, err
+	}
+	if v.fetched == nil {
+		v.fetched = map[string]*pkix.CertificateList{}
+	}
+	v.fetched[url] = crl
+	return crl, nil
+}
+
+// loadCRL reads a crl from an http url or a file, in pem or der
+func loadCRL(src string) (*pkix.CertificateList, error) {
+	var r io.Reader
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		resp, err := client.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		fd, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		r = fd
+	}
+	b, err := ReadBundle(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.CRLs) == 0 {
+		return nil, fmt.Errorf("%s: no crl found", src)
+	}
+	return b.CRLs[0], nil
+}
+
+// query asks the responder at url about c
+func query(url string, c, issuer *x509.Certificate) (*ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(c, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(url, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return ocsp.ParseResponseForCert(body, c, issuer)
+}
+
+var reasons = []string{
+	"unspecified",
+	"keyCompromise",
+	"CACompromise",
+	"affiliationChanged",
+	"superseded",
+	"cessationOfOperation",
+	"certificateHold",
+	"",
+	"removeFromCRL",
+	"privilegeWithdrawn",
+	"AACompromise",
+}
+
+func reason(n int) string {
+	if n < 0 || n >= len(reasons) || reasons[n] == "" {
+		return fmt.Sprintf("reason %d", n)
+	}
+	return reasons[n]
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestRevocationCRL(t *testing.T) {
+	p := newpki(t, nil)
+	other := newpki(t, nil)
+	crl := func(issuer *x509.Certificate, key crypto.Signer, next time.Time, revoked ...*x509.Certificate) *pkix.CertificateList {
+		var list []pkix.RevokedCertificate
+		for _, c := range revoked {
+			list = append(list, pkix.RevokedCertificate{SerialNumber: c.SerialNumber, RevocationTime: now.Add(-time.Hour)})
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:              big.NewInt(1),
+			ThisUpdate:          now.Add(-time.Hour),
+			NextUpdate:          next,
+			RevokedCertificates: list,
+		}, issuer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := x509.ParseCRL(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	fresh := now.Add(24 * time.Hour)
+	for _, v := range []struct {
+		name string
+		crls []*pkix.CertificateList
+		want int
+	}{
+		{"clean", []*pkix.CertificateList{crl(p.inter, p.interKey, fresh)}, ExitOK},
+		{"revoked leaf", []*pkix.CertificateList{crl(p.inter, p.interKey, fresh, p.leaf)}, ExitRevoked},
+		{"revoked inter", []*pkix.CertificateList{crl(p.root, p.rootKey, fresh, p.inter)}, ExitRevoked},
+		{"stale", []*pkix.CertificateList{crl(p.inter, p.interKey, now.Add(-time.Minute))}, ExitError},
+		{"unrelated issuer", []*pkix.CertificateList{crl(other.inter, other.interKey, fresh, other.leaf)}, ExitError},
+		{"one unrelated", []*pkix.CertificateList{
+			crl(p.inter, p.interKey, fresh),
+			crl(other.inter, other.interKey, fresh),
+		}, ExitError},
+	} {
+		v2 := &Revocation{CRLs: v.crls, Roots: []*x509.Certificate{p.root}}
+		r := Verify(p.chain(), "localhost", p.pool, now, 0)
+		v2.Check(r, p.chain(), now)
+		if have := r.Exit(); have != v.want {
+			t.Logf("%s: have exit %d, want %d: %+v", v.name, have, v.want, r.Problems)
+			t.Fail()
+		}
+		if r.Verified != (v.want == ExitOK) {
+			t.Logf("%s: verified is %v with exit %d", v.name, r.Verified, r.Exit())
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ExitWeak is the exit status of a scan that found weak suites
+const ExitWeak = 8
+
+var versionString = map[uint16]string{
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+	tls.VersionTLS13: "TLS1.3",
+}
+
+// versions are scanned in this order
+var versions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// ScanNote is printed with every scan: suites that crypto/tls
+// doesn't implement can't be offered, so they're never listed
+const ScanNote = "only suites implemented by go's crypto/tls are tried; " +
+	"dhe, dss, camellia, aria and psk suites aren't, and may be accepted"
+
+// ScanReport lists the versions and suites a server accepts
+type ScanReport struct {
+	Name     string
+	Versions []*VersionScan
+	Weak     []string
+	Note     string
+}
+
+// VersionScan is the result for one tls version. Suites lists
+// the suites the server accepted. Order lists them in the order
+// the server picks them when offered all the rest.
+type VersionScan struct {
+	Version  string
+	Accepted bool
+	Suites   []*SuiteScan `json:",omitempty"`
+	Order    []string     `json:",omitempty"`
+}
+
+type SuiteScan struct {
+	ID   string
+	Name string
+	Weak []string `json:",omitempty"`
+}
+
+func (r *ScanReport) Exit() int {
+	if len(r.Weak) > 0 {
+		return ExitWeak
+	}
+	return ExitOK
+}
+
+// Scan makes one handshake per version and suite, then finds the
+// order of the accepted suites by offering all of them, removing
+// the one the server picks, and offering the rest again.
+//
+// The suites of tls1.3 aren't configurable, so only the one the
+// server picks is reported. Suites that crypto/tls doesn't
+// implement are never offered.
+func Scan(srv, name string) (*ScanReport, error) {
+	r := &ScanReport{Name: name, Note: ScanNote}
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	for _, v := range versions {
+		vs := &VersionScan{Version: versionString[v]}
+		r.Versions = append(r.Versions, vs)
+		if v == tls.VersionTLS13 {
+			if id, err := handshake(srv, name, v, nil); err == nil {
+				vs.Accepted = true
+				vs.Suites = append(vs.Suites, newsuite(id))
+			} else if !isrefusal(err) {
+				return r, err
+			}
+			continue
+		}
+		var accepted []uint16
+		for _, s := range suites {
+			if !supports(s, v) {
+				continue
+			}
+			id, err := handshake(srv, name, v, []uint16{s.ID})
+			if err != nil {
+				if !isrefusal(err) {
+					return r, err
+				}
+				continue
+			}
+			accepted = append(accepted, id)
+			vs.Suites = append(vs.Suites, newsuite(id))
+		}
+		vs.Accepted = len(accepted) > 0
+		for len(accepted) > 0 {
+			id, err := handshake(srv, name, v, accepted)
+			if err != nil {
+				break
+			}
+			vs.Order = append(vs.Order, Suite(id).String())
+			accepted = remove(accepted, id)
+		}
+	}
+	reached := false
+	for _, vs := range r.Versions {
+		reached = reached || vs.Accepted
+		for _, s := range vs.Suites {
+			if len(s.Weak) > 0 && !contains(r.Weak, s.Name) {
+				r.Weak = append(r.Weak, s.Name)
+			}
+		}
+	}
+	if !reached {
+		return r, fmt.Errorf("scan: %s: no version or suite accepted", srv)
+	}
+	return r, nil
+}
+
+// handshake connects with one version and the given suites and
+// returns the suite the server picked
+func handshake(srv, name string, version uint16, suites []uint16) (uint16, error) {
+	fd, err := dial(srv, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         name,
+		MinVersion:         version,
+		MaxVersion:         version,
+		CipherSuites:       suites,
+	})
+	if fd != nil {
+		defer fd.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fd.ConnectionState().CipherSuite, nil
+}
+
+// isrefusal reports whether err came from the server declining
+// the handshake, rather than from failing to reach it
+func isrefusal(err error) bool {
+	var h *HandshakeError
+	return errors.As(err, &h)
+}
+
+func newsuite(id uint16) *SuiteScan {
+	s := &SuiteScan{ID: fmt.Sprintf("%#04x", id), Name: Suite(id).String()}
+	name := tls.CipherSuiteName(id)
+	for _, w := range []struct{ sub, why string }{
+		{"_RC4_", "rc4"},
+		{"_3DES_", "3des"},
+		{"_CBC_SHA", "cbc-sha"},
+		{"_NULL_", "null"},
+		{"_EXPORT_", "export"},
+	} {
+		if strings.Contains(name, w.sub) && (w.sub != "_CBC_SHA" || strings.HasSuffix(name, w.sub)) {
+			s.Weak = append(s.Weak, w.why)
+		}
+	}
+	if strings.HasPrefix(name, "TLS_RSA_") {
+		s.Weak = append(s.Weak, "no-forward-secrecy")
+	}
+	return s
+}
+
+func supports(s *tls.CipherSuite, v uint16) bool {
+	for _, sv := range s.SupportedVersions {
+		if sv == v {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(list []uint16, id uint16) (out []uint16) {
+	for _, v := range list {
+		if v != id {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
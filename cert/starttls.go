@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Upgrade runs a protocol's plaintext exchange up to the point
+// where the server expects a tls handshake
+type Upgrade struct {
+	Port string
+	Run  func(conn net.Conn, r *bufio.Reader) error
+}
+
+// upgrades are the protocols known to -starttls
+var upgrades = map[string]Upgrade{
+	"smtp":     {"25", smtp},
+	"imap":     {"143", imap},
+	"pop3":     {"110", pop3},
+	"ftp":      {"21", ftp},
+	"ldap":     {"389", ldap},
+	"postgres": {"5432", postgres},
+}
+
+// DialTimeout limits connecting, and UpgradeTimeout limits the
+// plaintext exchange
+const (
+	DialTimeout    = 30 * time.Second
+	UpgradeTimeout = 30 * time.Second
+)
+
+// starttls asks the server to begin tls using proto
+func starttls(conn net.Conn, proto string) error {
+	u, ok := upgrades[proto]
+	if !ok {
+		return fmt.Errorf("starttls: unknown protocol: %s", proto)
+	}
+	conn.SetDeadline(time.Now().Add(UpgradeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := u.Run(conn, bufio.NewReader(conn)); err != nil {
+		return fmt.Errorf("starttls: %s: %w", proto, err)
+	}
+	return nil
+}
+
+// dial connects to srv and begins tls, running the -starttls
+// upgrade first if one was given
+func dial(srv string, conf *tls.Config) (*tls.Conn, error) {
+	conn, err := net.DialTimeout(args.n, srv, DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if args.starttls != "" {
+		if err := starttls(conn, args.starttls); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	fd := tls.Client(conn, conf)
+	if err := fd.Handshake(); err != nil {
+		return fd, &HandshakeError{err}
+	}
+	return fd, nil
+}
+
+// HandshakeError is returned by dial when the server was reached
+// but the tls handshake failed
+type HandshakeError struct {
+	Err error
+}
+
+func (e *HandshakeError) Error() string { return e.Err.Error() }
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+// defaultport adds the protocol's port to srv if it has none
+func defaultport(srv, proto string) string {
+	if _, _, err := net.SplitHostPort(srv); err == nil {
+		return srv
+	}
+	if u, ok := upgrades[proto]; ok {
+		return net.JoinHostPort(srv, u.Port)
+	}
+	return srv
+}
+
+func send(w io.Writer, line string) error {
+	printdebug("send:", line)
+	_, err := io.WriteString(w, line+"\r\n")
+	return err
+}
+
+func readline(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	printdebug("recv:", line)
+	return line, nil
+}
+
+// reply reads a numbered reply, such as smtp or ftp use, and
+// checks its code. Lines of a multi-line reply have a dash
+// after the code, except for the last one.
+func reply(r *bufio.Reader, code string) error {
+	for {
+		line, err := readline(r)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, code) {
+			return fmt.Errorf("unexpected reply: %q", line)
+		}
+		if len(line) == len(code) || line[len(code)] != '-' {
+			return nil
+		}
+	}
+}
+
+func smtp(conn net.Conn, r *bufio.Reader) error {
+	if err := reply(r, "220"); err != nil {
+		return err
+	}
+	if err := send(conn, "EHLO cert"); err != nil {
+		return err
+	}
+	if err := reply(r, "250"); err != nil {
+		return err
+	}
+	if err := send(conn, "STARTTLS"); err != nil {
+		return err
+	}
+	return reply(r, "220")
+}
+
+func ftp(conn net.Conn, r *bufio.Reader) error {
+	if err := reply(r, "220"); err != nil {
+		return err
+	}
+	if err := send(conn, "AUTH TLS"); err != nil {
+		return err
+	}
+	return reply(r, "234")
+}
+
+func imap(conn net.Conn, r *bufio.Reader) error {
+	line, err := readline(r)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "* OK") {
+		return fmt.Errorf("unexpected greeting: %q", line)
+	}
+	if err := send(conn, "a1 STARTTLS"); err != nil {
+		return err
+	}
+	for {
+		line, err := readline(r)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "* ") {
+			continue
+		}
+		if !strings.HasPrefix(line, "a1 OK") {
+			return fmt.Errorf("unexpected reply: %q", line)
+		}
+		return nil
+	}
+}
+
+func pop3(conn net.Conn, r *bufio.Reader) error {
+	for _, cmd := range []string{"", "STLS"} {
+		if cmd != "" {
+			if err := send(conn, cmd); err != nil {
+				return err
+			}
+		}
+		line, err := readline(r)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "+OK") {
+			return fmt.Errorf("unexpected reply: %q", line)
+		}
+	}
+	return nil
+}
+
+// LDAPStartTLS is the oid of the ldap starttls extended operation
+const LDAPStartTLS = "1.3.6.1.4.1.1466.20037"
+
+// ldap sends an ExtendedRequest for starttls and checks the
+// resultCode of the ExtendedResponse
+//
+//	LDAPMessage ::= SEQUENCE { messageID INTEGER,
+//		[APPLICATION 23] SEQUENCE { requestName [0] OCTET STRING } }
+func ldap(conn net.Conn, r *bufio.Reader) error {
+	name := append([]byte{0x80, byte(len(LDAPStartTLS))}, LDAPStartTLS...)
+	op := append([]byte{0x77, byte(len(name))}, name...)
+	msg := append([]byte{0x02, 0x01, 0x01}, op...)
+	if _, err := conn.Write(append([]byte{0x30, byte(len(msg))}, msg...)); err != nil {
+		return err
+	}
+	_, body, err := readber(r)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(bytes.NewReader(body))
+	if tag, _, err := readber(br); err != nil || tag != 0x02 {
+		return fmt.Errorf("bad response: messageID: tag %#x: %v", tag, err)
+	}
+	tag, resp, err := readber(br)
+	if err != nil || tag != 0x78 {
+		return fmt.Errorf("bad response: not an ExtendedResponse: tag %#x: %v", tag, err)
+	}
+	br = bufio.NewReader(bytes.NewReader(resp))
+	tag, code, err := readber(br)
+	if err != nil || tag != 0x0a || len(code) != 1 {
+		return fmt.Errorf("bad response: resultCode: tag %#x: %v", tag, err)
+	}
+	if code[0] != 0 {
+		return fmt.Errorf("refused: resultCode %d", code[0])
+	}
+	return nil
+}
+
+// readber reads one ber element
+func readber(r *bufio.Reader) (tag byte, body []byte, err error) {
+	if tag, err = r.ReadByte(); err != nil {
+		return 0, nil, err
+	}
+	n, err := r.ReadByte()
+	if err != nil {
+		return tag, nil, err
+	}
+	size := int(n)
+	if n&0x80 != 0 {
+		if n &= 0x7f; n == 0 || n > 4 {
+			return tag, nil, fmt.Errorf("ber: bad length")
+		}
+		size = 0
+		for ; n > 0; n-- {
+			b, err := r.ReadByte()
+			if err != nil {
+				return tag, nil, err
+			}
+			size = size<<8 | int(b)
+		}
+	}
+	body = make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	return tag, body, err
+}
+
+// PostgresSSLRequest is the protocol version of an SSLRequest
+const PostgresSSLRequest = 80877103
+
+func postgres(conn net.Conn, r *bufio.Reader) error {
+	var req [8]byte
+	binary.BigEndian.PutUint32(req[0:], 8)
+	binary.BigEndian.PutUint32(req[4:], PostgresSSLRequest)
+	if _, err := conn.Write(req[:]); err != nil {
+		return err
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case 'S':
+		return nil
+	case 'N':
+		return fmt.Errorf("server does not support ssl")
+	}
+	return fmt.Errorf("unexpected reply: %q", b)
+}
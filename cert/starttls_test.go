@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// standin speaks the server side of a protocol up to the tls
+// handshake. If refuse is set, it declines to start tls.
+type standin func(conn net.Conn, r *bufio.Reader, refuse bool) error
+
+var standins = map[string]standin{
+	"smtp": func(conn net.Conn, r *bufio.Reader, refuse bool) error {
+		io.WriteString(conn, "220-cert.test ESMTP\r\n220 ready\r\n")
+		if err := expect(r, "EHLO "); err != nil {
+			return err
+		}
+		io.WriteString(conn, "250-cert.test\r\n250 STARTTLS\r\n")
+		if err := expect(r, "STARTTLS"); err != nil {
+			return err
+		}
+		return answer(conn, refuse, "220 go ahead", "454 tls not available")
+	},
+	"imap": func(conn net.Conn, r *bufio.Reader, refuse bool) error {
+		io.WriteString(conn, "* OK ready\r\n")
+		if err := expect(r, "a1 STARTTLS"); err != nil {
+			return err
+		}
+		io.WriteString(conn, "* CAPABILITY IMAP4rev1\r\n")
+		return answer(conn, refuse, "a1 OK begin tls", "a1 NO not now")
+	},
+	"pop3": func(conn net.Conn, r *bufio.Reader, refuse bool) error {
+		io.WriteString(conn, "+OK ready\r\n")
+		if err := expect(r, "STLS"); err != nil {
+			return err
+		}
+		return answer(conn, refuse, "+OK begin tls", "-ERR not now")
+	},
+	"ftp": func(conn net.Conn, r *bufio.Reader, refuse bool) error {
+		io.WriteString(conn, "220 ready\r\n")
+		if err := expect(r, "AUTH TLS"); err != nil {
+			return err
+		}
+		return answer(conn, refuse, "234 begin tls", "502 not now")
+	},
+	"ldap": func(conn net.Conn, r *bufio.Reader, refuse bool) error {
+		tag, msg, err := readber(r)
+		if err != nil {
+			return err
+		}
+		if tag != 0x30 || !bytes.Contains(msg, []byte(LDAPStartTLS)) {
+			return fmt.Errorf("ldap: not a starttls request: %x", msg)
+		}
+		code := byte(0)
+		if refuse {
+			code = 2
+		}
+		resp := []byte{0x0a, 0x01, code, 0x04, 0x00, 0x04, 0x00}
+		op := append([]byte{0x78, byte(len(resp))}, resp...)
+		body := append([]byte{0x02, 0x01, 0x01}, op...)
+		_, err = conn.Write(append([]byte{0x30, byte(len(body))}, body...))
+		return err
+	},
+	"postgres": func(conn net.Conn, r *bufio.Reader, refuse bool) error {
+		var req [8]byte
+		if _, err := io.ReadFull(r, req[:]); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(req[4:]) != PostgresSSLRequest {
+			return fmt.Errorf("postgres: not an SSLRequest: %x", req)
+		}
+		reply := "S"
+		if refuse {
+			reply = "N"
+		}
+		_, err := io.WriteString(conn, reply)
+		return err
+	},
+}
+
+func expect(r *bufio.Reader, prefix string) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, prefix) {
+		return fmt.Errorf("have %q, want %q", line, prefix)
+	}
+	return nil
+}
+
+func answer(w io.Writer, refuse bool, ok, no string) error {
+	if refuse {
+		ok = no
+	}
+	_, err := io.WriteString(w, ok+"\r\n")
+	return err
+}
+
+// selfsigned returns a throwaway certificate for localhost
+func selfsigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serve accepts one connection on a new listener, runs fn on it,
+// and then completes the tls handshake unless refuse is set. The
+// error from the server side is sent on the returned channel.
+func serve(t *testing.T, fn standin, refuse bool) (addr string, done chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{selfsigned(t)}}
+	done = make(chan error, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err = fn(conn, bufio.NewReader(conn), refuse); err == nil && !refuse {
+			err = tls.Server(conn, conf).Handshake()
+		}
+		done <- err
+	}()
+	return ln.Addr().String(), done
+}
+
+func TestStartTLS(t *testing.T) {
+	args.n = "tcp"
+	defer func() { args.starttls = "" }()
+	for proto, fn := range standins {
+		args.starttls = proto
+		addr, done := serve(t, fn, false)
+		fd, err := dial(addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Logf("%s: dial: %s", proto, err)
+			t.Fail()
+			continue
+		}
+		if !fd.ConnectionState().HandshakeComplete {
+			t.Logf("%s: handshake incomplete", proto)
+			t.Fail()
+		}
+		fd.Close()
+		if err := <-done; err != nil {
+			t.Logf("%s: stand-in: %s", proto, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestStartTLSRefused(t *testing.T) {
+	args.n = "tcp"
+	defer func() { args.starttls = "" }()
+	for proto, fn := range standins {
+		args.starttls = proto
+		addr, done := serve(t, fn, true)
+		_, err := dial(addr, &tls.Config{InsecureSkipVerify: true})
+		if err == nil || !strings.HasPrefix(err.Error(), "starttls: "+proto) {
+			t.Logf("%s: have %v, want a starttls error", proto, err)
+			t.Fail()
+		}
+		if _, ok := err.(*HandshakeError); ok {
+			t.Logf("%s: refusal reported as a handshake error", proto)
+			t.Fail()
+		}
+		<-done
+	}
+}
+
+func TestStartTLSGarbage(t *testing.T) {
+	args.n = "tcp"
+	defer func() { args.starttls = "" }()
+	garbage := func(conn net.Conn, r *bufio.Reader, refuse bool) error {
+		_, err := io.WriteString(conn, "bogus\r\n")
+		return err
+	}
+	for proto := range standins {
+		args.starttls = proto
+		addr, done := serve(t, garbage, true)
+		if _, err := dial(addr, &tls.Config{InsecureSkipVerify: true}); err == nil {
+			t.Logf("%s: garbage accepted", proto)
+			t.Fail()
+		}
+		<-done
+	}
+}
+
+func TestStartTLSUnknown(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := starttls(c1, "gopher"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestDefaultPort(t *testing.T) {
+	for _, v := range [][3]string{
+		{"mail.example", "smtp", "mail.example:25"},
+		{"mail.example:587", "smtp", "mail.example:587"},
+		{"db.example", "postgres", "db.example:5432"},
+		{"example", "gopher", "example"},
+	} {
+		if have := defaultport(v[0], v[1]); have != v[2] {
+			t.Logf("defaultport(%q, %q): have %q, want %q", v[0], v[1], have, v[2])
+			t.Fail()
+		}
+	}
+}
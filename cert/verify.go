@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit status for each kind of problem. When a chain has several
+// problems, cert exits with the status of the most severe.
+const (
+	ExitOK        = 0
+	ExitError     = 1
+	ExitUntrusted = 2 // chain doesn't lead to a trusted root
+	ExitOrder     = 3 // chain is out of order or has a bad signature
+	ExitExpired   = 4 // a certificate expired or isn't valid yet
+	ExitHostname  = 5 // leaf doesn't match the hostname
+	ExitUsage     = 6 // key usage doesn't permit the certificate's role
+	ExitExpiring  = 7 // a certificate expires within -expires
+)
+
+// Problem is one verification failure. Cert is the index of the
+// offending certificate in the chain, or -1 for the whole chain.
+type Problem struct {
+	Kind   string
+	Exit   int
+	Cert   int
+	Detail string
+}
+
+// Report is the result of verifying a chain
+type Report struct {
+	Name     string `json:",omitempty"`
+	File     string `json:",omitempty"`
+	Verified bool
+	Expires  time.Time
+	Problems []Problem
+}
+
+// Exit returns the exit status for the report
+func (r *Report) Exit() int {
+	code := ExitOK
+	for _, p := range r.Problems {
+		code = worst(code, p.Exit)
+	}
+	return code
+}
+
+func (r *Report) add(kind string, exit, cert int, format string, v ...interface{}) {
+	r.Problems = append(r.Problems, Problem{kind, exit, cert, fmt.Sprintf(format, v...)})
+}
+
+// Verify checks the chain as presented, leaf first. Roots is nil
+// for the system roots. If name is empty, neither the hostname
+// nor server auth usage is checked.
+func Verify(chain []*x509.Certificate, name string, roots *x509.CertPool, now time.Time, within time.Duration) *Report {
+	r := &Report{Name: name}
+	if len(chain) == 0 {
+		r.add("empty", ExitError, -1, "no certificates")
+		return r
+	}
+	leaf := chain[0]
+	r.Expires = leaf.NotAfter
+	for i, c := range chain {
+		if c.NotAfter.Before(r.Expires) {
+			r.Expires = c.NotAfter
+		}
+		switch {
+		case now.After(c.NotAfter):
+			r.add("expired", ExitExpired, i, "expired %s ago on %s", days(now.Sub(c.NotAfter)), c.NotAfter)
+		case now.Before(c.NotBefore):
+			r.add("notyetvalid", ExitExpired, i, "not valid until %s", c.NotBefore)
+		case within > 0 && c.NotAfter.Sub(now) < within:
+			r.add("expiring", ExitExpiring, i, "expires in %s on %s", days(c.NotAfter.Sub(now)), c.NotAfter)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := chain[i-1]
+		if !bytes.Equal(prev.RawIssuer, c.RawSubject) {
+			r.add("order", ExitOrder, i, "not the issuer of certificate %d: %s", i-1, prev.Issuer)
+		} else if err := prev.CheckSignatureFrom(c); err != nil {
+			r.add("order", ExitOrder, i, "certificate %d: %s", i-1, err)
+		}
+		if !c.IsCA || c.KeyUsage != 0 && c.KeyUsage&x509.KeyUsageCertSign == 0 {
+			r.add("usage", ExitUsage, i, "not permitted to sign certificates")
+		}
+	}
+	if name != "" {
+		if err := leaf.VerifyHostname(name); err != nil {
+			r.add("hostname", ExitHostname, 0, "%s", err)
+		}
+	}
+	if name != "" && !serverauth(leaf) {
+		r.add("usage", ExitUsage, 0, "extended key usage doesn't permit server auth")
+	}
+
+	// Verify trust separately from expiry, hostname and usage so
+	// each problem is reported once. If the leaf expired, verify
+	// as of the day before it did.
+	at := now
+	if now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+		at = leaf.NotAfter.Add(-time.Second)
+	}
+	inter := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		inter.AddCert(c)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: inter,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	var (
+		unknown x509.UnknownAuthorityError
+		invalid x509.CertificateInvalidError
+	)
+	switch {
+	case err == nil:
+	case errors.As(err, &unknown):
+		r.add("untrusted", ExitUntrusted, -1, "%s", err)
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		// reported above
+	default:
+		r.add("untrusted", ExitUntrusted, -1, "%s", err)
+	}
+	r.Verified = len(r.Problems) == 0
+	return r
+}
+
+func serverauth(c *x509.Certificate) bool {
+	if len(c.ExtKeyUsage) == 0 && len(c.UnknownExtKeyUsage) == 0 {
+		return true
+	}
+	for _, u := range c.ExtKeyUsage {
+		if u == x509.ExtKeyUsageServerAuth || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// roots returns the certificates in the -ca file and a pool of
+// them, or a nil pool for the system roots
+func roots(file string) ([]*x509.Certificate, *x509.CertPool, error) {
+	if file == "" {
+		return nil, nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := ReadBundle(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", file, err)
+	}
+	pool := x509.NewCertPool()
+	for _, c := range b.Certs {
+		pool.AddCert(c)
+	}
+	return b.Certs, pool, nil
+}
+
+// severity orders exit statuses from most to least severe
+var severity = []int{
+	ExitError, ExitRevoked, ExitUntrusted, ExitOrder, ExitExpired,
+	ExitHostname, ExitUsage, ExitExpiring, ExitWeak,
+}
+
+func rank(code int) int {
+	for i, c := range severity {
+		if c == code {
+			return i
+		}
+	}
+	return len(severity)
+}
+
+// worst returns the exit status that takes precedence
+func worst(a, b int) int {
+	if a == ExitOK || b != ExitOK && rank(b) < rank(a) {
+		return b
+	}
+	return a
+}
+
+// parsedays parses a duration. A "d" suffix counts days.
+func parsedays(s string) (time.Duration, error) {
+	if n := strings.TrimSuffix(s, "d"); n != s {
+		d, err := strconv.Atoi(n)
+		if err != nil {
+			return 0, fmt.Errorf("bad duration: %s", s)
+		}
+		return time.Duration(d) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func days(d time.Duration) string {
+	if d < 48*time.Hour {
+		return d.Round(time.Minute).String()
+	}
+	return fmt.Sprintf("%dd", d/(24*time.Hour))
+}
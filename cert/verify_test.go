@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// pki is a root, an intermediate and a leaf for localhost
+type pki struct {
+	root, inter, leaf          *x509.Certificate
+	rootKey, interKey, leafKey crypto.Signer
+	pool                       *x509.CertPool
+}
+
+var serial int64
+
+// issue signs tmpl with the parent's key. If parent is nil,
+// the certificate is self-signed.
+func issue(t *testing.T, tmpl, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	tmpl.SerialNumber = big.NewInt(serial)
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = now.Add(-24 * time.Hour)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotAfter = now.Add(365 * 24 * time.Hour)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, key
+}
+
+func ca(name string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+}
+
+func leaf() *x509.Certificate {
+	return &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+}
+
+// newpki issues a chain. If tmpl is not nil, it's used for the leaf.
+func newpki(t *testing.T, tmpl *x509.Certificate) *pki {
+	t.Helper()
+	p := &pki{}
+	p.root, p.rootKey = issue(t, ca("root"), nil, nil)
+	p.inter, p.interKey = issue(t, ca("inter"), p.root, p.rootKey)
+	if tmpl == nil {
+		tmpl = leaf()
+	}
+	p.leaf, p.leafKey = issue(t, tmpl, p.inter, p.interKey)
+	p.pool = x509.NewCertPool()
+	p.pool.AddCert(p.root)
+	return p
+}
+
+func (p *pki) chain() []*x509.Certificate {
+	return []*x509.Certificate{p.leaf, p.inter}
+}
+
+func TestVerify(t *testing.T) {
+	expired := leaf()
+	expired.NotAfter = now.Add(-48 * time.Hour)
+	expired.NotBefore = now.Add(-96 * time.Hour)
+	early := leaf()
+	early.NotBefore = now.Add(24 * time.Hour)
+	expiring := leaf()
+	expiring.NotAfter = now.Add(5 * 24 * time.Hour)
+	client := leaf()
+	client.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	for _, v := range []struct {
+		name  string
+		leaf  *x509.Certificate
+		host  string
+		trust bool
+		want  int
+	}{
+		{"good", nil, "localhost", true, ExitOK},
+		{"no name", nil, "", true, ExitOK},
+		{"untrusted", nil, "localhost", false, ExitUntrusted},
+		{"hostname", nil, "example.com", true, ExitHostname},
+		{"expired", expired, "localhost", true, ExitExpired},
+		{"not yet valid", early, "localhost", true, ExitExpired},
+		{"expiring", expiring, "localhost", true, ExitExpiring},
+		{"client auth", client, "localhost", true, ExitUsage},
+		{"client auth without name", client, "", true, ExitOK},
+		{"expired beats hostname", expired, "example.com", true, ExitExpired},
+		{"hostname beats expiring", expiring, "example.com", true, ExitHostname},
+	} {
+		p := newpki(t, v.leaf)
+		roots := p.pool
+		if !v.trust {
+			roots = x509.NewCertPool()
+		}
+		r := Verify(p.chain(), v.host, roots, now, 30*24*time.Hour)
+		if have := r.Exit(); have != v.want {
+			t.Logf("%s: have exit %d, want %d: %+v", v.name, have, v.want, r.Problems)
+			t.Fail()
+		}
+		if r.Verified != (v.want == ExitOK) {
+			t.Logf("%s: verified is %v with exit %d", v.name, r.Verified, r.Exit())
+			t.Fail()
+		}
+	}
+}
+
+func TestVerifyExpiredOnce(t *testing.T) {
+	expired := leaf()
+	expired.NotAfter = now.Add(-48 * time.Hour)
+	expired.NotBefore = now.Add(-96 * time.Hour)
+	p := newpki(t, expired)
+	r := Verify(p.chain(), "localhost", p.pool, now, 0)
+	if len(r.Problems) != 1 || r.Problems[0].Kind != "expired" || r.Problems[0].Cert != 0 {
+		t.Logf("have %+v, want one expired problem for the leaf", r.Problems)
+		t.Fail()
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	p := newpki(t, nil)
+	other := newpki(t, nil)
+	notca := ca("inter")
+	notca.IsCA = false
+	notca.KeyUsage = x509.KeyUsageDigitalSignature
+	inter, interKey := issue(t, notca, p.root, p.rootKey)
+	l, _ := issue(t, leaf(), inter, interKey)
+
+	for _, v := range []struct {
+		name  string
+		chain []*x509.Certificate
+		want  int
+		kind  string
+	}{
+		{"empty", nil, ExitError, "empty"},
+		{"reversed", []*x509.Certificate{p.inter, p.leaf}, ExitOrder, "order"},
+		{"wrong intermediate", []*x509.Certificate{p.leaf, other.inter}, ExitUntrusted, "order"},
+		{"with root", []*x509.Certificate{p.leaf, p.inter, p.root}, ExitOK, ""},
+		{"intermediate not a ca", []*x509.Certificate{l, inter}, ExitUntrusted, "usage"},
+	} {
+		r := Verify(v.chain, "localhost", p.pool, now, 0)
+		if have := r.Exit(); have != v.want {
+			t.Logf("%s: have exit %d, want %d: %+v", v.name, have, v.want, r.Problems)
+			t.Fail()
+		}
+		found := v.kind == ""
+		for _, pr := range r.Problems {
+			found = found || pr.Kind == v.kind
+		}
+		if !found {
+			t.Logf("%s: no %s problem in %+v", v.name, v.kind, r.Problems)
+			t.Fail()
+		}
+	}
+}
+
+func TestWorst(t *testing.T) {
+	for _, v := range [][3]int{
+		{ExitOK, ExitOK, ExitOK},
+		{ExitOK, ExitWeak, ExitWeak},
+		{ExitWeak, ExitOK, ExitWeak},
+		{ExitExpiring, ExitExpired, ExitExpired},
+		{ExitExpired, ExitExpiring, ExitExpired},
+		{ExitRevoked, ExitUntrusted, ExitRevoked},
+		{ExitError, ExitRevoked, ExitError},
+		{ExitUsage, ExitHostname, ExitHostname},
+		{ExitWeak, ExitExpiring, ExitExpiring},
+	} {
+		if have := worst(v[0], v[1]); have != v[2] {
+			t.Logf("worst(%d, %d): have %d, want %d", v[0], v[1], have, v[2])
+			t.Fail()
+		}
+	}
+	for i := 1; i < len(severity); i++ {
+		if rank(severity[i-1]) >= rank(severity[i]) {
+			t.Logf("rank: %d doesn't outrank %d", severity[i-1], severity[i])
+			t.Fail()
+		}
+	}
+	r := &Report{}
+	for _, code := range []int{ExitWeak, ExitExpiring, ExitOrder, ExitUsage} {
+		r.add("test", code, -1, "")
+	}
+	if have := r.Exit(); have != ExitOrder {
+		t.Logf("report: have exit %d, want %d", have, ExitOrder)
+		t.Fail()
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{filepath.Join(dir, "nosuch"), dir} {
+		if have := openfile(name); have != ExitError {
+			t.Logf("%s: have exit %d, want %d", name, have, ExitError)
+			t.Fail()
+		}
+	}
+}
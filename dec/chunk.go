@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ChunkSize is the largest plaintext sealed in one record
+const ChunkSize = 64 * 1024
+
+// Record flags
+const (
+	RecordLast = 1 << iota // no records follow
+)
+
+// Chunked stream errors
+var (
+	ErrTruncated = errors.New("chunked: stream truncated: last record missing")
+	ErrTrailing  = errors.New("chunked: data after last record")
+)
+
+// In chunked mode, each read of the plaintext is sealed into its own
+// record so dec can emit it without waiting for the end of the stream.
+//
+//	seq[8] flags[1] len[4] ciphertext[len]
+//
+// The file header and the first 13 bytes are authenticated as
+// additional data and the sequence number is xored into the nonce,
+// so dec rejects records that are reordered, replayed, forged, or
+// moved under another header. The stream ends with a
+// record flagged RecordLast. A stream without one was truncated.
+type record struct {
+	seq   uint64
+	flags byte
+	n     uint32
+}
+
+const recordHeader = 8 + 1 + 4
+
+func (h record) bytes() []byte {
+	b := make([]byte, recordHeader)
+	binary.BigEndian.PutUint64(b, h.seq)
+	b[8] = h.flags
+	binary.BigEndian.PutUint32(b[9:], h.n)
+	return b
+}
+
+// chunknonce returns the nonce for record seq
+func chunknonce(nonce []byte, seq uint64) []byte {
+	n := append([]byte(nil), nonce...)
+	var s [8]byte
+	binary.BigEndian.PutUint64(s[:], seq)
+	for i := range s {
+		n[len(n)-8+i] ^= s[i]
+	}
+	return n
+}
+
+// chunkad returns the additional data for a record: the file
+// header followed by the record header
+func chunkad(a *AEAD, rec []byte) []byte {
+	return append(append(make([]byte, 0, len(a.AD)+len(rec)), a.AD...), rec...)
+}
+
+// sealchunks encrypts the plaintext read from r as a series of
+// records, writing each one as soon as it is read
+func sealchunks(w io.Writer, r io.Reader, a *AEAD) (n int, err error) {
+	if a.Prefix {
+		if n, err = w.Write(a.Nonce); err != nil {
+			return n, err
+		}
+	}
+	buf := make([]byte, ChunkSize)
+	for seq := uint64(0); ; {
+		m, rerr := r.Read(buf)
+		if rerr != nil && rerr != io.EOF {
+			return n, rerr
+		}
+		if m == 0 && rerr == nil {
+			continue
+		}
+		h := record{seq: seq, n: uint32(m + a.Overhead())}
+		if rerr == io.EOF {
+			h.flags |= RecordLast
+		}
+		rec := h.bytes()
+		out := a.Seal(rec, chunknonce(a.Nonce, seq), buf[:m], chunkad(a, rec))
+		m, err = w.Write(out)
+		n += m
+		if err != nil || h.flags&RecordLast != 0 {
+			return n, err
+		}
+		seq++
+	}
+}
+
+// openchunks authenticates and decrypts the records read from r,
+// writing the plaintext of each record as soon as it's verified
+func openchunks(w io.Writer, r io.Reader, a *AEAD) (n int, err error) {
+	nonce := a.Nonce
+	if a.Prefix {
+		nonce = make([]byte, a.NonceSize())
+		if _, err := io.ReadFull(r, nonce); err != nil {
+			return 0, ErrTruncated
+		}
+	}
+	rec := make([]byte, recordHeader)
+	buf := make([]byte, ChunkSize+a.Overhead())
+	for seq := uint64(0); ; seq++ {
+		if _, err := io.ReadFull(r, rec); err != nil {
+			return n, ErrTruncated
+		}
+		h := record{
+			seq:   binary.BigEndian.Uint64(rec),
+			flags: rec[8],
+			n:     binary.BigEndian.Uint32(rec[9:]),
+		}
+		if h.seq != seq {
+			return n, fmt.Errorf("chunked: record %d: out of sequence: want %d", h.seq, seq)
+		}
+		if int(h.n) > len(buf) || int(h.n) < a.Overhead() {
+			return n, fmt.Errorf("chunked: record %d: bad length: %d", h.seq, h.n)
+		}
+		msg := buf[:h.n]
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return n, ErrTruncated
+		}
+		p, err := a.Open(msg[:0], chunknonce(nonce, seq), msg, chunkad(a, rec))
+		if err != nil {
+			return n, ErrAuth
+		}
+		m, err := w.Write(p)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if h.flags&RecordLast != 0 {
+			var b [1]byte
+			if m, _ := io.ReadFull(r, b[:]); m != 0 {
+				return n, ErrTrailing
+			}
+			return n, nil
+		}
+	}
+}
@@ -43,11 +43,18 @@ var (
 var args struct {
 	h, q    bool
 	r       bool
+	raw     bool
+	c       bool
 	a, s, m string
 	l       int
 	k, f, e string
 	i       string
-	p       string
+	p       bool
+	pv      string
+	kdf     string
+	cost    int
+	to      recipients
+	key     string
 }
 
 var f *flag.FlagSet
@@ -170,18 +177,24 @@ func Alg(std, mode string, key []byte) (opmode interface{}, err error) {
 	a := &algorithm{
 		Std(std),
 		Mode(mode),
-		Keylen(len(key)),
+		Keylen(strconv.Itoa(len(key))),
 	}
 	if bits := len(key) * 8; bits != args.l {
 		return nil, fmt.Errorf("bad key length for %s: %d", args.s, bits)
 	}
+	if aead, err := NewAEAD(a.Std, a.Mode, key); aead != nil || err != nil {
+		return aead, err
+	}
 	block, err := a.SetCipher(key)
 	if err != nil {
 		return nil, err
 	}
 	BlockSize = block.BlockSize()
 	iv := mustiv(BlockSize)
-	return a.SetMode(block, iv), nil
+	if opmode = a.SetMode(block, iv); opmode == nil {
+		return nil, fmt.Errorf("mode not found: %s", mode)
+	}
+	return opmode, nil
 }
 
 func init() {
@@ -198,10 +211,20 @@ func init() {
 	f.StringVar(&args.k, "k", Unset, "")
 	f.StringVar(&args.f, "f", Unset, "")
 	f.StringVar(&args.e, "e", Unset, "")
-	f.StringVar(&args.p, "p", Unset, "")
+	f.BoolVar(&args.p, "p", false, "")
+	f.StringVar(&args.pv, "P", Unset, "")
+	f.StringVar(&args.kdf, "kdf", KDFScrypt, "")
+	f.IntVar(&args.cost, "cost", 0, "")
+	f.Var(&args.to, "to", "")
+	f.StringVar(&args.key, "key", Unset, "")
 
 	f.BoolVar(&args.r, "r", false, "")
+	f.BoolVar(&args.raw, "raw", false, "")
+	f.BoolVar(&args.c, "c", false, "")
 	f.StringVar(&args.i, "i", "", "")
+}
+
+func argparse() {
 	err := mute.Parse(f, os.Args[1:])
 	if err != nil {
 		printerr(err)
@@ -222,6 +245,7 @@ func operation(s string) func(io.Writer, io.Reader, cipher.BlockMode) (int, erro
 }
 
 func main() {
+	argparse()
 	if args.h || args.q {
 		usage()
 	}
@@ -231,14 +255,56 @@ func main() {
 		r   = os.Stdin
 	)
 
+	var hdr bytes.Buffer
+	if !args.raw {
+		header = &Header{}
+		if Role == "dec" {
+			header, err = ReadHeader(io.TeeReader(r, &hdr))
+			dieon(err)
+			dieon(checkalg(header.Alg))
+			args.a = header.Alg
+			args.i = hex.EncodeToString(header.IV)
+			args.r = header.Flags&FlagRandom != 0
+			args.c = header.Flags&FlagChunked != 0
+		}
+	}
+
 	mustparsealg()
 	alg, err := Alg(args.s, args.m, mustkey())
 	if err != nil {
 		printerr(err)
 		os.Exit(1)
 	}
+	if _, ok := alg.(*AEAD); args.c && !ok {
+		dieon(fmt.Errorf("chunked: mode is not authenticated: %s", args.m))
+	}
+
+	if header != nil && Role == "enc" {
+		header.Alg = fmt.Sprintf("%s/%s/%d", args.s, args.m, args.l)
+		if args.r {
+			header.Flags |= FlagRandom
+		}
+		if args.c {
+			header.Flags |= FlagChunked
+		}
+		_, err = header.WriteTo(io.MultiWriter(w, &hdr))
+		dieon(err)
+	}
+	if t, ok := alg.(*AEAD); ok && header != nil {
+		t.AD = hdr.Bytes()
+	}
 
 	switch t := alg.(type) {
+	case *AEAD:
+		if args.c && Role == "enc" {
+			_, err = sealchunks(w, r, t)
+		} else if args.c {
+			_, err = openchunks(w, r, t)
+		} else if Role == "enc" {
+			_, err = seal(w, r, t)
+		} else {
+			_, err = open(w, r, t)
+		}
 	case cipher.BlockMode:
 		_, err = operation(Role)(w, r, t)
 	case cipher.Stream:
@@ -261,7 +327,7 @@ func stream(w io.Writer, r io.Reader, s cipher.Stream) (int64, error) {
 	if args.r && Role == "enc" {
 		r = randinject(r, BlockSize)
 	}
-	sr := cipher.StreamReader{s, r}
+	sr := cipher.StreamReader{S: s, R: r}
 	if args.r && Role == "dec" {
 		if n, err := io.CopyN(ioutil.Discard, sr, int64(BlockSize)); err != nil {
 			return n, err
@@ -345,6 +411,24 @@ func mustkey() (key []byte) {
 			n++
 		}
 	}
+	passphrase := args.p || args.pv != Unset
+	public := len(args.to) > 0 || args.key != Unset
+	if passphrase && (n > 0 || public) || public && n > 0 {
+		dieon(fmt.Errorf("key: too many keys"))
+	}
+	switch {
+	case len(args.to) > 0 && Role == "enc":
+		return mustwrap(args.l / 8)
+	case args.key != Unset && Role == "dec":
+		return mustunwrap()
+	case public:
+		dieon(fmt.Errorf("key: enc takes -to, dec takes -key"))
+	case n == 0 && header != nil && len(header.Recipients) > 0:
+		dieon(fmt.Errorf("key: ciphertext is for recipients: use -key"))
+	}
+	if passphrase || n == 0 && header != nil && header.KDF != nil {
+		return mustderive()
+	}
 	if n != 1 {
 		dieon(fmt.Errorf("key: not provided"))
 	}
@@ -365,14 +449,23 @@ func mustkey() (key []byte) {
 	return nil
 }
 
+// mustiv returns the iv given with -i. Otherwise, the iv is
+// random if enc is writing a header, or zero.
 func mustiv(bs int) (iv []byte) {
 	iv = musthex(args.i)
 	if len(iv) == 0 {
 		iv = make([]byte, bs)
+		if header != nil && Role == "enc" {
+			_, err := rand.Read(iv)
+			dieon(err)
+		}
 	}
 	if bs != len(iv) {
 		dieon(fmt.Errorf("iv: bad length: %d: need blocksize: %d", bs, len(iv)))
 	}
+	if header != nil {
+		header.IV = iv
+	}
 	return iv
 }
 
@@ -418,18 +511,21 @@ func mustatoi(a string) int {
 func usage() {
 	fmt.Printf(`
 NAME
-	%[1]s - %[1]ssrypt messages
+	%[1]s - %[1]srypt messages
 
 SYNOPSIS
-	%[1]s [-a alg] [-r | -i iv ] -e keyvar
+	%[1]s [-a alg] [-r | -i iv ] [-raw] -e keyvar
 	%[1]s [ options ] -f keyfile
 	%[1]s [ options ] -k key
+	%[1]s [ options ] [-kdf name] [-cost n] -p | -P passvar
+	%[1]s [ options ] -to pubkey [-to pubkey ...]
+	%[1]s [ options ] -key privkey
 
 DESCRIPTION
 
 	DO NOT USE THIS PROGRAM FOR SERIOUS CRYPTOGRAPHIC WORK
 
-	%s encrypts plaintext from stdin and outputs resulting
+	%[1]s encrypts plaintext from stdin and outputs resulting
 	ciphertext to stdout. It uses the encryption alogrithm alg
 	and padding algorithm PKCS#7.
 
@@ -440,7 +536,7 @@ DESCRIPTION
 			Mode defaults to cbc for block ciphers and default 
 			blocksize for std.
 
-	The next options provide the encryption key to %s. The key is
+	The next options provide the encryption key to %[1]s. The key is
 	hex encoded. Whitespace is truncated, any other runes are
 	invalid.
 
@@ -448,18 +544,77 @@ DESCRIPTION
 	-k key   Key is the key itself
 	-f file  File names the file containing the key on the first line.
 
+	Instead of a key, a passphrase may be given. The key is derived
+	from the passphrase and a random salt. The salt and cost are
+	stored in the header, so dec prompts for the passphrase when
+	no key is given.
+
+	-p          Prompt for the passphrase on the terminal
+	-P var      Var names the environment variable holding the passphrase
+	-kdf name   Key derivation function: scrypt (default) or pbkdf2
+	-cost n     Scrypt: log2 of the cost N (default 15). Pbkdf2:
+	            iterations of hmac-sha256 (default 310000)
+
+	Or, enc encrypts to one or more public keys. It chooses a random
+	content key and wraps it for each recipient in the header. Any
+	recipient can decrypt with their private key.
+
+	-to file    Encrypt to the public key in the pem file. The file may
+	            hold a certificate, a public key, or a private key.
+	            X25519 keys are wrapped with an ephemeral key exchange
+	            and chacha20/poly1305; rsa keys with rsa-oaep/sha256.
+	            Repeat -to for more recipients.
+	-key file   Decrypt with the X25519 or rsa private key in the pem
+	            file (pkcs#1 or pkcs#8)
+
 	Options for semantic security. Ignored for ebc mode
 	and stream ciphers. 
 
 	-r       Random block is prepended to the plaintext and encrypted
 	-i iv    Initialization vector (hex encoded)
 
+	Authenticated modes (gcm, poly1305) use a random nonce. Set -i
+	to use a fixed nonce instead. Never reuse a nonce with the same key.
+
+HEADER
+	Enc writes a small versioned header before the ciphertext. It
+	holds the algorithm, the iv or nonce, whether -r was used, and
+	the key derivation parameters for passphrase keys, and the
+	content key wrapped for each -to recipient. Dec reads the
+	header and configures itself, so only the key must be given to
+	dec; -a, -i, and -r are ignored.
+
+	Authenticated modes authenticate the header along with the
+	ciphertext. Other modes can't, so dec refuses a header that
+	names one unless -a names the same algorithm.
+
+	Without -i, enc chooses a random iv or nonce and stores it in
+	the header.
+
+	-raw     Write or read raw ciphertext without a header. The iv
+	         is zero unless -i is given. Authenticated modes write
+	         a random nonce before the ciphertext unless -i is given.
+	         Both sides must use the same -a, -i and -r options.
+
+CHUNKED
+	Authenticated modes normally seal the whole input at once, and
+	block modes can't finish the last block until EOF. Interactive
+	sessions stall. With -c, enc seals each read of its input as a
+	separate record, and dec writes each record's plaintext as soon
+	as it is authenticated. Records are numbered and the last one is
+	marked, so dec fails if records are reordered, replayed, dropped
+	or truncated. Plaintext already written stays written.
+
+	-c       Chunked records (authenticated modes only). Recorded in
+	         the header; with -raw, dec must be given -c as well.
+
 ALGORITHMS
-	Only aes, des, and des3 is enabled at this time.
+	Only aes, des, des3 and chacha20 are enabled at this time.
 
 	aes       Advanced Encryption Standard
 	des       Data Encryption Standard
 	des3      Triple DES
+	chacha20  ChaCha20 (only with poly1305)
 
 	otp       One-time pad
 	blowfish  Blowfish
@@ -470,11 +625,14 @@ ALGORITHMS
 	xtea      Xtea
 
 BLOCK MODES
-	Only cbc and ecb is enabled at this time. Using ecb provides
-	you with zero security. Use at your own risk.
+	Only cbc, ecb, ctr, ofb, gcm and poly1305 are enabled at this
+	time. Using ecb provides you with zero security. Use at your
+	own risk.
 
 	cbc       Cipher Block Chaining	
 	ecb       Elecrtonic Code Book
+	gcm       Galois/Counter Mode (authenticated, aes only)
+	poly1305  ChaCha20-Poly1305 (authenticated, chacha20 only)
 
 	cbf       Cipher Feedback
 	crt       Counter
@@ -498,9 +656,35 @@ EXAMPLE
 		kv=00112233445566778899aabbccddeeff
 		enc -a aes/cbc/128 -e kv < m
 
-BUGS
-	No GCM
+	Encrypt and authenticate m with aes/gcm/256. Dec exits with
+	a non-zero status and writes nothing if the ciphertext was
+	modified.
+
+		enc -a aes/gcm/256 -e kv < m > c
+		dec -e kv < c
 
+	Or use chacha20/poly1305/256 instead.
+
+	Share a file by passphrase. Dec reads the salt and cost
+	from the header and prompts for the passphrase.
+
+		enc -a aes/gcm/256 -p < m > c
+		dec < c
+
+	Encrypt an interactive session with dial and listen.
+
+		listen :9000 dec -e kv
+		enc -c -a aes/gcm/256 -e kv | dial :9000
+
+	Encrypt an archive for two team members. Alice has an rsa key
+	and certificate from gen; bob has an X25519 key.
+
+		openssl genpkey -algorithm x25519 -out bob.key
+		openssl pkey -in bob.key -pubout -out bob.pub
+		tar c dir | enc -a aes/gcm/256 -to alice.pem -to bob.pub > c
+		dec -key bob.key < c | tar x
+
+BUGS
 	ECB mode produces ciphertext that reveals patterns in
 	the underlying plaintext:
 
@@ -508,9 +692,12 @@ BUGS
 		enc(B², K) → C²
 		C¹ = C² if B¹ = B²
 
-	Enc and dec do not authenticate unless a standard operating
-	mode supports bundled authentication. Use HMAC and friends
+	Enc and dec do not authenticate unless an authenticated mode
+	(gcm, poly1305) is used. For other modes, use HMAC and friends
 	to implement authentication alongsize enc and dec.
+
+	Authenticated modes hold the entire message in memory,
+	unless -c is used.
 	
 
 SEE ALSO
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// Magic identifies a ciphertext header. The byte after the
+// magic is the header version.
+const (
+	Magic   = "ENC"
+	Version = 1
+)
+
+// Header flags
+const (
+	FlagRandom     = 1 << iota // a random block is prepended (-r)
+	FlagKDF                    // the key is derived from a passphrase
+	FlagChunked                // the ciphertext is a series of records (-c)
+	FlagRecipients             // the key is wrapped for recipients (-to)
+)
+
+// MaxRecipients is the most recipients a header can hold
+const MaxRecipients = 255
+
+// ErrRecipients is returned when there are too many recipients
+var ErrRecipients = fmt.Errorf("recipients: more than %d", MaxRecipients)
+
+// ErrNoHeader is returned by ReadHeader when the input doesn't
+// start with a header
+var ErrNoHeader = errors.New("no header: input is raw ciphertext or not from enc (try -raw)")
+
+// Header is written by enc before the ciphertext so dec can
+// configure itself. All variable-length fields are prefixed
+// with a one byte length.
+//
+//	magic[3] version[1] flags[1] alg[n] iv[n]
+//	kdf: name[n] salt[n] nparams[1] params[4*nparams]
+//	recipients: nstanzas[1] { type[n] body[2+n] }
+//
+// The kdf fields are only present if FlagKDF is set, and the
+// recipients if FlagRecipients is set. Stanza bodies have a two
+// byte length.
+type Header struct {
+	Flags      byte
+	Alg        string
+	IV         []byte
+	KDF        *KDF
+	Recipients []*Stanza
+}
+
+// KDF describes how the key was derived from a passphrase
+type KDF struct {
+	Name   string
+	Salt   []byte
+	Params []uint32
+}
+
+// header is the header being written by enc or the header read
+// by dec. It is nil with -raw.
+var header *Header
+
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	if len(h.Recipients) > MaxRecipients {
+		return 0, ErrRecipients
+	}
+	var b bytes.Buffer
+	b.WriteString(Magic)
+	b.WriteByte(Version)
+	flags := h.Flags &^ (FlagKDF | FlagRecipients)
+	if h.KDF != nil {
+		flags |= FlagKDF
+	}
+	if len(h.Recipients) > 0 {
+		flags |= FlagRecipients
+	}
+	b.WriteByte(flags)
+	putbytes(&b, []byte(h.Alg))
+	putbytes(&b, h.IV)
+	if h.KDF != nil {
+		putbytes(&b, []byte(h.KDF.Name))
+		putbytes(&b, h.KDF.Salt)
+		b.WriteByte(byte(len(h.KDF.Params)))
+		for _, p := range h.KDF.Params {
+			binary.Write(&b, binary.BigEndian, p)
+		}
+	}
+	if len(h.Recipients) > 0 {
+		b.WriteByte(byte(len(h.Recipients)))
+		for _, s := range h.Recipients {
+			putbytes(&b, []byte(s.Type))
+			binary.Write(&b, binary.BigEndian, uint16(len(s.Body)))
+			b.Write(s.Body)
+		}
+	}
+	return b.WriteTo(w)
+}
+
+// ReadHeader reads a header from r
+func ReadHeader(r io.Reader) (*Header, error) {
+	var pre [5]byte
+	if _, err := io.ReadFull(r, pre[:]); err != nil {
+		return nil, ErrNoHeader
+	}
+	if string(pre[:3]) != Magic {
+		return nil, ErrNoHeader
+	}
+	if pre[3] != Version {
+		return nil, fmt.Errorf("header: unsupported version: %d", pre[3])
+	}
+	h := &Header{Flags: pre[4]}
+	alg, err := getbytes(r)
+	if err != nil {
+		return nil, err
+	}
+	h.Alg = string(alg)
+	if h.IV, err = getbytes(r); err != nil {
+		return nil, err
+	}
+	if h.Flags&FlagKDF != 0 {
+		if h.KDF, err = readkdf(r); err != nil {
+			return nil, err
+		}
+	}
+	if h.Flags&FlagRecipients != 0 {
+		if h.Recipients, err = readstanzas(r); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// checkalg refuses a header that names an unauthenticated mode
+// unless -a names the same algorithm. Only authenticated modes
+// cover the header, so a forged header could otherwise turn a
+// gcm ciphertext into a ctr one that decrypts to chosen text.
+func checkalg(alg string) error {
+	if authenticated(alg) || given("a") && args.a == alg {
+		return nil
+	}
+	return fmt.Errorf("header: %s is not authenticated: confirm it with -a %s", alg, alg)
+}
+
+// given reports whether the named flag was set on the command line
+func given(name string) (ok bool) {
+	f.Visit(func(fl *flag.Flag) {
+		ok = ok || fl.Name == name
+	})
+	return ok
+}
+
+func readkdf(r io.Reader) (*KDF, error) {
+	k := &KDF{}
+	name, err := getbytes(r)
+	if err != nil {
+		return nil, err
+	}
+	k.Name = string(name)
+	if k.Salt, err = getbytes(r); err != nil {
+		return nil, err
+	}
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	k.Params = make([]uint32, n[0])
+	if err := binary.Read(r, binary.BigEndian, k.Params); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func readstanzas(r io.Reader) ([]*Stanza, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	list := make([]*Stanza, n[0])
+	for i := range list {
+		typ, err := getbytes(r)
+		if err != nil {
+			return nil, err
+		}
+		var size uint16
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, fmt.Errorf("header: truncated")
+		}
+		list[i] = &Stanza{Type: string(typ), Body: body}
+	}
+	return list, nil
+}
+
+func putbytes(b *bytes.Buffer, p []byte) {
+	b.WriteByte(byte(len(p)))
+	b.Write(p)
+}
+
+func getbytes(r io.Reader) ([]byte, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	p := make([]byte, n[0])
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, fmt.Errorf("header: truncated")
+	}
+	return p, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// roundtrip writes h and reads it back
+func roundtrip(t *testing.T, h *Header) {
+	t.Helper()
+	var b bytes.Buffer
+	if _, err := h.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	h2, err := ReadHeader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, h2) {
+		t.Logf("have %+v, want %+v", h2, h)
+		t.Fail()
+	}
+	if b.Len() != 0 {
+		t.Logf("%d bytes left after header", b.Len())
+		t.Fail()
+	}
+}
+
+// truncated checks that every prefix of h is rejected
+func truncated(t *testing.T, h *Header) {
+	t.Helper()
+	var b bytes.Buffer
+	h.WriteTo(&b)
+	full := b.Bytes()
+	for i := 0; i < len(full); i++ {
+		if _, err := ReadHeader(bytes.NewReader(full[:i])); err == nil {
+			t.Logf("truncated at %d: no error", i)
+			t.Fail()
+		}
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	roundtrip(t, &Header{Alg: "aes/gcm", IV: []byte("0123456789ab")})
+	roundtrip(t, &Header{Flags: FlagChunked | FlagRandom, Alg: "chacha20/poly1305", IV: make([]byte, 12)})
+	roundtrip(t, &Header{Alg: "aes/cbc", IV: make([]byte, 16)})
+}
+
+func TestHeaderFlags(t *testing.T) {
+	// WriteTo derives FlagKDF and FlagRecipients from the fields
+	h := &Header{Flags: FlagKDF | FlagRecipients, Alg: "aes/gcm"}
+	var b bytes.Buffer
+	h.WriteTo(&b)
+	h2, err := ReadHeader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2.Flags != 0 || h2.KDF != nil || h2.Recipients != nil {
+		t.Logf("have %+v, want no kdf or recipients", h2)
+		t.Fail()
+	}
+}
+
+func TestHeaderBad(t *testing.T) {
+	truncated(t, &Header{Alg: "aes/gcm", IV: make([]byte, 12)})
+	for _, v := range []string{"", "EN", "XYZ\x01\x00", "ENC\x02\x00"} {
+		if _, err := ReadHeader(strings.NewReader(v)); err == nil {
+			t.Logf("%q: no error", v)
+			t.Fail()
+		}
+	}
+}
+
+func TestHeaderAuth(t *testing.T) {
+	a := testaead(t, false)
+	h := &Header{Alg: "aes/gcm/256", IV: a.Nonce}
+	var b bytes.Buffer
+	h.WriteTo(&b)
+	a.AD = b.Bytes()
+	var sealed bytes.Buffer
+	if _, err := seal(&sealed, strings.NewReader("attack at dawn"), a); err != nil {
+		t.Fatal(err)
+	}
+	var plain bytes.Buffer
+	if _, err := open(&plain, bytes.NewReader(sealed.Bytes()), a); err != nil || plain.String() != "attack at dawn" {
+		t.Fatalf("open: have %q %v", plain.String(), err)
+	}
+
+	iv := append([]byte(nil), a.Nonce...)
+	iv[0] ^= 1
+	for _, forged := range []*Header{
+		{Alg: "aes/ctr/256", IV: append(a.Nonce, 0, 0, 0, 2)},
+		{Alg: "chacha20/poly1305/256", IV: a.Nonce},
+		{Alg: "aes/gcm/256", IV: a.Nonce, Flags: FlagRandom},
+		{Alg: "aes/gcm/256", IV: a.Nonce, Flags: FlagChunked},
+		{Alg: "aes/gcm/256", IV: iv},
+	} {
+		var b bytes.Buffer
+		forged.WriteTo(&b)
+		a.AD = b.Bytes()
+		if _, err := open(&plain, bytes.NewReader(sealed.Bytes()), a); err != ErrAuth {
+			t.Logf("forged header %+v: have %v, want %v", forged, err, ErrAuth)
+			t.Fail()
+		}
+	}
+}
+
+func TestCheckAlg(t *testing.T) {
+	defer func(f0 *flag.FlagSet, a string) { f, args.a = f0, a }(f, args.a)
+	for _, v := range []struct {
+		a   string // -a, if given
+		alg string // from the header
+		ok  bool
+	}{
+		{"", "aes/gcm/256", true},
+		{"", "chacha20/poly1305/256", true},
+		{"", "aes/ctr/256", false},
+		{"", "aes/cbc/256", false},
+		{"aes/ctr/256", "aes/ctr/256", true},
+		{"aes/cbc/256", "aes/ctr/256", false},
+		{"aes/gcm/256", "aes/ofb/256", false},
+	} {
+		f = flag.NewFlagSet("test", flag.ContinueOnError)
+		f.StringVar(&args.a, "a", "aes/cbc/256", "")
+		if v.a != "" {
+			f.Parse([]string{"-a", v.a})
+		}
+		if err := checkalg(v.alg); (err == nil) != v.ok {
+			t.Logf("-a %q, header %q: have %v, want ok=%v", v.a, v.alg, err, v.ok)
+			t.Fail()
+		}
+	}
+}
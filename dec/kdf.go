@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Key derivation functions for passphrase keys
+const (
+	KDFScrypt = "scrypt"
+	KDFPBKDF2 = "pbkdf2"
+)
+
+// Default costs: log2(N) for scrypt, iterations for pbkdf2
+const (
+	ScryptCost = 15
+	PBKDF2Cost = 310000
+	SaltSize   = 16
+)
+
+// Maximum costs accepted from a header, so that a crafted
+// file can't exhaust memory or time: scrypt uses 128·N·r·p
+// bytes, 512 MiB at the limit.
+const (
+	MaxScryptCost = 22
+	MaxScryptRP   = 32
+	MaxPBKDF2Cost = 10000000
+)
+
+// NewKDF returns the parameters for a new key derivation with
+// a random salt. A zero cost selects the default cost.
+func NewKDF(name string, cost int) (*KDF, error) {
+	k := &KDF{Name: name, Salt: make([]byte, SaltSize)}
+	if _, err := rand.Read(k.Salt); err != nil {
+		return nil, err
+	}
+	switch name {
+	case KDFScrypt:
+		if cost == 0 {
+			cost = ScryptCost
+		}
+		k.Params = []uint32{uint32(cost), 8, 1}
+	case KDFPBKDF2:
+		if cost == 0 {
+			cost = PBKDF2Cost
+		}
+		k.Params = []uint32{uint32(cost)}
+	default:
+		return nil, fmt.Errorf("kdf not found: %s", name)
+	}
+	return k, k.check()
+}
+
+// check returns an error if the parameters are malformed
+// or exceed the maximum costs
+func (k *KDF) check() error {
+	switch {
+	case k.Name == KDFScrypt && len(k.Params) == 3:
+		logN, r, p := k.Params[0], uint64(k.Params[1]), uint64(k.Params[2])
+		if logN < 1 || logN > MaxScryptCost {
+			return fmt.Errorf("scrypt: cost %d not in [1, %d]", logN, MaxScryptCost)
+		}
+		if r < 1 || p < 1 || r*p > MaxScryptRP {
+			return fmt.Errorf("scrypt: r·p = %d·%d exceeds %d", r, p, MaxScryptRP)
+		}
+		return nil
+	case k.Name == KDFPBKDF2 && len(k.Params) == 1:
+		if n := k.Params[0]; n < 1 || n > MaxPBKDF2Cost {
+			return fmt.Errorf("pbkdf2: cost %d not in [1, %d]", n, MaxPBKDF2Cost)
+		}
+		return nil
+	}
+	return fmt.Errorf("kdf: bad parameters: %s %v", k.Name, k.Params)
+}
+
+// Derive derives a key of n bytes from the passphrase
+func (k *KDF) Derive(pass []byte, n int) ([]byte, error) {
+	if err := k.check(); err != nil {
+		return nil, err
+	}
+	if k.Name == KDFScrypt {
+		logN, r, p := k.Params[0], int(k.Params[1]), int(k.Params[2])
+		return scrypt.Key(pass, k.Salt, 1<<logN, r, p, n)
+	}
+	return pbkdf2.Key(pass, k.Salt, int(k.Params[0]), n, sha256.New), nil
+}
+
+// mustpassphrase returns the passphrase from the environment
+// variable named by -P, or prompts for it on the terminal. Enc
+// asks for the passphrase twice.
+func mustpassphrase() []byte {
+	if args.pv != Unset {
+		pass, ok := os.LookupEnv(args.pv)
+		if !ok {
+			dieon(fmt.Errorf("passphrase: $%s is not set", args.pv))
+		}
+		return []byte(pass)
+	}
+	tty, err := os.OpenFile(ttyname(), os.O_RDWR, 0)
+	dieon(err)
+	defer tty.Close()
+	prompt := func(msg string) []byte {
+		fmt.Fprint(os.Stderr, msg)
+		pass, err := term.ReadPassword(int(tty.Fd()))
+		fmt.Fprintln(os.Stderr)
+		dieon(err)
+		return pass
+	}
+	pass := prompt("passphrase: ")
+	if Role == "enc" && !bytes.Equal(pass, prompt("again: ")) {
+		dieon(fmt.Errorf("passphrase: mismatch"))
+	}
+	return pass
+}
+
+func ttyname() string {
+	if runtime.GOOS == "windows" {
+		return "CONIN$"
+	}
+	return "/dev/tty"
+}
+
+// mustderive derives the key from a passphrase. Enc chooses a
+// new salt and stores the parameters in the header, dec reads
+// them from the header.
+func mustderive() []byte {
+	if header == nil {
+		dieon(fmt.Errorf("passphrase: can't be used with -raw"))
+	}
+	if Role == "enc" {
+		k, err := NewKDF(args.kdf, args.cost)
+		dieon(err)
+		header.KDF = k
+	}
+	if header.KDF == nil {
+		dieon(fmt.Errorf("passphrase: ciphertext was not encrypted with a passphrase"))
+	}
+	key, err := header.KDF.Derive(mustpassphrase(), args.l/8)
+	dieon(err)
+	return key
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Recipient key types
+const (
+	StanzaX25519 = "x25519"
+	StanzaRSA    = "rsa-oaep"
+)
+
+// ErrNoStanza is returned when none of the recipient stanzas in
+// the header can be opened with the private key
+var ErrNoStanza = errors.New("key: not a recipient: no stanza opens with this key")
+
+// oidX25519 identifies X25519 keys in PKIX and PKCS#8 structures
+var oidX25519 = asn1.ObjectIdentifier{1, 3, 101, 110}
+
+// Stanza holds the content key wrapped for one recipient
+type Stanza struct {
+	Type string
+	Body []byte
+}
+
+// Recipient wraps a content key for the holder of a private key
+type Recipient interface {
+	Wrap(key []byte) (*Stanza, error)
+}
+
+// Identity unwraps a content key from a stanza
+type Identity interface {
+	Unwrap(s *Stanza) ([]byte, error)
+}
+
+// X25519Recipient wraps keys with an ephemeral X25519 exchange. The
+// stanza body is the ephemeral public key followed by the content
+// key sealed with chacha20/poly1305 under sha256(shared, epk, pk).
+type X25519Recipient []byte
+
+// X25519Identity is an X25519 private key
+type X25519Identity []byte
+
+func (r X25519Recipient) Wrap(key []byte) (*Stanza, error) {
+	esk := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(esk); err != nil {
+		return nil, err
+	}
+	epk, err := curve25519.X25519(esk, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(esk, r)
+	if err != nil {
+		return nil, err
+	}
+	a, err := chacha20poly1305.New(kek(shared, epk, r))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, a.NonceSize())
+	return &Stanza{Type: StanzaX25519, Body: a.Seal(epk, nonce, key, nil)}, nil
+}
+
+func (id X25519Identity) Unwrap(s *Stanza) ([]byte, error) {
+	if s.Type != StanzaX25519 || len(s.Body) < curve25519.PointSize {
+		return nil, ErrNoStanza
+	}
+	pk, err := curve25519.X25519(id, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	epk, sealed := s.Body[:curve25519.PointSize], s.Body[curve25519.PointSize:]
+	shared, err := curve25519.X25519(id, epk)
+	if err != nil {
+		return nil, ErrNoStanza
+	}
+	a, err := chacha20poly1305.New(kek(shared, epk, pk))
+	if err != nil {
+		return nil, err
+	}
+	key, err := a.Open(nil, make([]byte, a.NonceSize()), sealed, nil)
+	if err != nil {
+		return nil, ErrNoStanza
+	}
+	return key, nil
+}
+
+func kek(shared, epk, pk []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(StanzaX25519))
+	h.Write(shared)
+	h.Write(epk)
+	h.Write(pk)
+	return h.Sum(nil)
+}
+
+// RSARecipient wraps keys with RSA-OAEP and sha256
+type RSARecipient struct{ *rsa.PublicKey }
+
+// RSAIdentity is an RSA private key
+type RSAIdentity struct{ *rsa.PrivateKey }
+
+func (r RSARecipient) Wrap(key []byte) (*Stanza, error) {
+	body, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, r.PublicKey, key, []byte(StanzaRSA))
+	if err != nil {
+		return nil, err
+	}
+	return &Stanza{Type: StanzaRSA, Body: body}, nil
+}
+
+func (id RSAIdentity) Unwrap(s *Stanza) ([]byte, error) {
+	if s.Type != StanzaRSA {
+		return nil, ErrNoStanza
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, id.PrivateKey, s.Body, []byte(StanzaRSA))
+	if err != nil {
+		return nil, ErrNoStanza
+	}
+	return key, nil
+}
+
+// recipients is the list of public key files given with -to
+type recipients []string
+
+func (r *recipients) String() string     { return strings.Join(*r, ",") }
+func (r *recipients) Set(s string) error { *r = append(*r, s); return nil }
+
+// ReadRecipient reads a public key from a PEM file. The file may hold
+// a certificate, a PKIX or PKCS#1 public key, or a private key.
+func ReadRecipient(file string) (Recipient, error) {
+	blocks, err := readpem(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		var pub interface{}
+		switch b.Type {
+		case "CERTIFICATE":
+			c, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			pub = c.PublicKey
+		case "PUBLIC KEY":
+			if pub, err = parsepkix(b.Bytes); err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+		case "RSA PUBLIC KEY":
+			if pub, err = x509.ParsePKCS1PublicKey(b.Bytes); err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+		default:
+			id, err := parseidentity(b)
+			if err != nil {
+				continue
+			}
+			switch id := id.(type) {
+			case X25519Identity:
+				pk, err := curve25519.X25519(id, curve25519.Basepoint)
+				if err != nil {
+					return nil, err
+				}
+				return X25519Recipient(pk), nil
+			case RSAIdentity:
+				return RSARecipient{&id.PublicKey}, nil
+			}
+		}
+		switch pub := pub.(type) {
+		case X25519Recipient:
+			return pub, nil
+		case *rsa.PublicKey:
+			return RSARecipient{pub}, nil
+		default:
+			return nil, fmt.Errorf("%s: unsupported public key type: %T", file, pub)
+		}
+	}
+	return nil, fmt.Errorf("%s: no public key found", file)
+}
+
+// ReadIdentity reads a private key from a PEM file
+func ReadIdentity(file string) (Identity, error) {
+	blocks, err := readpem(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		if id, err := parseidentity(b); err == nil {
+			return id, nil
+		} else if err != errNotKey {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil, fmt.Errorf("%s: no private key found", file)
+}
+
+var errNotKey = errors.New("not a private key")
+
+func parseidentity(b *pem.Block) (Identity, error) {
+	switch b.Type {
+	case "RSA PRIVATE KEY":
+		k, err := x509.ParsePKCS1PrivateKey(b.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return RSAIdentity{k}, nil
+	case "PRIVATE KEY":
+		var p8 struct {
+			Version int
+			Algo    pkix.AlgorithmIdentifier
+			Key     []byte
+		}
+		if _, err := asn1.Unmarshal(b.Bytes, &p8); err != nil {
+			return nil, err
+		}
+		if p8.Algo.Algorithm.Equal(oidX25519) {
+			var k []byte
+			if _, err := asn1.Unmarshal(p8.Key, &k); err != nil {
+				return nil, err
+			}
+			if len(k) != curve25519.ScalarSize {
+				return nil, fmt.Errorf("x25519: bad private key length: %d", len(k))
+			}
+			return X25519Identity(k), nil
+		}
+		k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if k, ok := k.(*rsa.PrivateKey); ok {
+			return RSAIdentity{k}, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type: %T", k)
+	}
+	return nil, errNotKey
+}
+
+func parsepkix(der []byte) (interface{}, error) {
+	var spki struct {
+		Algo pkix.AlgorithmIdentifier
+		Key  asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+	if spki.Algo.Algorithm.Equal(oidX25519) {
+		if len(spki.Key.Bytes) != curve25519.PointSize {
+			return nil, fmt.Errorf("x25519: bad public key length: %d", len(spki.Key.Bytes))
+		}
+		return X25519Recipient(spki.Key.Bytes), nil
+	}
+	return x509.ParsePKIXPublicKey(der)
+}
+
+func readpem(file string) (blocks []*pem.Block, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var b *pem.Block
+		b, data = pem.Decode(data)
+		if b == nil {
+			break
+		}
+		blocks = append(blocks, b)
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("%s: not a pem file", file)
+	}
+	return blocks, nil
+}
+
+// mustwrap chooses a random content key and wraps it for each
+// recipient given with -to
+func mustwrap(n int) []byte {
+	if header == nil {
+		dieon(fmt.Errorf("recipients: can't be used with -raw"))
+	}
+	if len(args.to) > MaxRecipients {
+		dieon(ErrRecipients)
+	}
+	key := make([]byte, n)
+	_, err := rand.Read(key)
+	dieon(err)
+	for _, file := range args.to {
+		r, err := ReadRecipient(file)
+		dieon(err)
+		s, err := r.Wrap(key)
+		dieon(err)
+		header.Recipients = append(header.Recipients, s)
+	}
+	return key
+}
+
+// mustunwrap unwraps the content key in the header with the
+// private key given with -key
+func mustunwrap() []byte {
+	if header == nil || len(header.Recipients) == 0 {
+		dieon(fmt.Errorf("key: ciphertext has no recipients"))
+	}
+	id, err := ReadIdentity(args.key)
+	dieon(err)
+	for _, s := range header.Recipients {
+		if key, err := id.Unwrap(s); err == nil {
+			return key
+		}
+	}
+	dieon(ErrNoStanza)
+	return nil
+}
@@ -27,25 +27,12 @@ var args struct {
 	h, q, v bool
 	k       bool
 	m       bool
+	f       bool
 	a       int
 	n       string
-}
 
-func init() {
-	f = flag.NewFlagSet("main", flag.ContinueOnError)
-	f.BoolVar(&args.h, "h", false, "")
-	f.BoolVar(&args.q, "?", false, "")
-	f.BoolVar(&args.v, "v", false, "")
-	f.BoolVar(&args.k, "k", false, "")
-	f.BoolVar(&args.m, "m", false, "")
-	f.IntVar(&args.a, "a", 4096, "")
-	f.StringVar(&args.n, "n", "tcp4", "")
-
-	err := mute.Parse(f, os.Args[1:])
-	if err != nil {
-		printerr(err)
-		os.Exit(1)
-	}
+	tls                bool
+	ca, cert, pin, sni string
 }
 
 func init() {
@@ -55,9 +42,17 @@ func init() {
 	f.BoolVar(&args.v, "v", false, "")
 	f.BoolVar(&args.k, "k", false, "")
 	f.BoolVar(&args.m, "m", false, "")
+	f.BoolVar(&args.f, "f", false, "")
 	f.IntVar(&args.a, "a", 4096, "")
 	f.StringVar(&args.n, "n", "tcp4", "")
+	f.BoolVar(&args.tls, "tls", false, "")
+	f.StringVar(&args.ca, "ca", "", "")
+	f.StringVar(&args.cert, "cert", "", "")
+	f.StringVar(&args.pin, "pin", "", "")
+	f.StringVar(&args.sni, "sni", "", "")
+}
 
+func argparse() {
 	err := mute.Parse(f, os.Args[1:])
 	if err != nil {
 		printerr(err)
@@ -68,6 +63,7 @@ func init() {
 var f *flag.FlagSet
 
 func main() {
+	argparse()
 	nargs := len(f.Args())
 	if args.h || args.q || nargs == 0 {
 		usage()
@@ -77,7 +73,10 @@ func main() {
 	srv := f.Args()[0]
 	cmd := f.Args()[1:]
 
-	fd, err := net.Dial(args.n, srv)
+	if args.f && (args.m || len(cmd) > 0) {
+		sysfatal(errFramed)
+	}
+	fd, err := connect(args.n, srv)
 	sysfatal(err)
 
 	if args.m {
@@ -96,13 +95,22 @@ func stream(fd net.Conn, cmd ...string) {
 			return
 		}
 		verb("dial:", cfd.RemoteAddr().String())
-		if len(cmd) == 0 {
-			err := term3(cfd)
-			printerr(err)
-		} else {
-			err := run3(cfd, cmd[0], cmd[1:]...)
+		status := 0
+		switch {
+		case args.f:
+			status, err = term3f(cfd)
+		case len(cmd) == 0:
+			err = term3(cfd)
+		default:
+			err = run3(cfd, cmd[0], cmd[1:]...)
+		}
+		if err != nil {
 			printerr(err)
 		}
+		if status != 0 {
+			cfd.Close()
+			os.Exit(status)
+		}
 	}(fd)
 }
 func streammux(fd net.Conn, cmd ...string) {
@@ -149,6 +157,29 @@ func streammux(fd net.Conn, cmd ...string) {
 	}
 }
 
+// connect dials srv, over tls if -tls is set. It exits
+// with a distinct status if the connection fails.
+func connect(network, srv string) (net.Conn, error) {
+	if !args.tls {
+		fd, err := net.Dial(network, srv)
+		if err != nil {
+			printerr(err)
+			os.Exit(ExitConnect)
+		}
+		return fd, nil
+	}
+	conf, err := tlsconfig(srv, args.sni, args.ca, args.cert, args.pin)
+	if err != nil {
+		return nil, err
+	}
+	fd, code, err := dialtls(network, srv, conf)
+	if err != nil {
+		printerr(err)
+		os.Exit(code)
+	}
+	return fd, nil
+}
+
 func sysfatal(err error) {
 	if err == nil {
 		return
@@ -180,6 +211,9 @@ func term3(rw net.Conn) (err error) {
 		if _, err := io.Copy(rw, os.Stdin); err != nil {
 			printerr("stdin|net", err)
 		}
+		if cw, ok := rw.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
 	}()
 	return <-fin
 }
@@ -235,12 +269,13 @@ func printerr(v ...interface{}) {
 }
 
 func usage() {
-	fmt.Println(`
+	fmt.Print(`
 NAME
 	dial - connect to a listener
 
 SYNOPSIS
 	dial [-v -k -r rflags] [-p proto] [host]:port [cmd args ...]
+	dial -tls [-ca ca.pem] [-cert cert.pem,key.pem] [-pin sha256] [host]:port [cmd args ...]
 	dial example.com:80 
 
 DESCRIPTION
@@ -253,6 +288,30 @@ DESCRIPTION
 	instead connected to dial's standard input, output, and
 	error.
 
+FRAMING
+	Set -f on both dial and listen to send stdin, stdout, stderr
+	and the exit status of cmd as separate channels over the
+	connection. Dial writes the remote stdout and stderr to its
+	own and exits with the remote exit status. -f can't be used
+	with cmd.
+
+TLS
+	Set -tls to speak tls. The server's certificate is verified
+	against the system pool, or the certificates in -ca. The
+	server name defaults to the host in the dial string.
+
+	-ca ca.pem             Verify the server against ca.pem
+	-cert cert.pem,key.pem Present a client certificate
+	-pin sha256            Require the server's leaf certificate to
+	                       have this sha256 fingerprint (hex)
+	-sni name              Server name to send and verify
+
+EXIT STATUS
+	0  Success
+	1  Usage or runtime error
+	2  The connection failed
+	3  The server's certificate was rejected
+
 EXAMPLE
 	Speak HTTP
 		echo GET / HTTP/1.1 | ./dial example.com:80
@@ -262,9 +321,17 @@ EXAMPLE
 		# All calls to localhost:80 now go to 10.2.64.20:3389
 		rd localhost:80 
 
+	Reach a listen -tls server with a gen certificate
+		dial -tls -ca cert.pem localhost:443
+
+	Run a remote build step, keeping stderr and the exit status
+		listen -f :802 make
+		dial -f host:802 >build.log
+
 BUGS
 	Redundant on Plan 9.
 
-	Stdout and stderr are fused together into a miserable gulash.
+	Without -f, stdout and stderr are fused together into a
+	miserable gulash.
 `)
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Framed mode (-f) multiplexes stdin, stdout, stderr and the
+// exit status of cmd over one connection. A frame is a one byte
+// channel, a four byte big-endian payload length, and the payload.
+// An empty frame closes the channel. The exit frame carries the
+// decimal exit status of cmd and is the last frame sent.
+const (
+	chStdin  = 0
+	chStdout = 1
+	chStderr = 2
+	chExit   = 3
+)
+
+// MaxFrame is the largest payload accepted from the peer.
+// Larger writes are split into several frames.
+const MaxFrame = 1 << 20
+
+var errFrameSize = fmt.Errorf("frame: payload exceeds %d bytes", MaxFrame)
+
+// framer serializes frames written to w
+type framer struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (f *framer) Frame(ch byte, p []byte) error {
+	f.Lock()
+	defer f.Unlock()
+	var hdr [5]byte
+	hdr[0] = ch
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(p)))
+	if _, err := f.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := f.w.Write(p)
+	return err
+}
+
+// chanWriter writes each buffer as a frame on one channel
+type chanWriter struct {
+	f  *framer
+	ch byte
+}
+
+func (c *chanWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		m := len(p)
+		if m > MaxFrame {
+			m = MaxFrame
+		}
+		if err = c.f.Frame(c.ch, p[:m]); err != nil {
+			return n, err
+		}
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (c *chanWriter) Close() error {
+	return c.f.Frame(c.ch, nil)
+}
+
+func readframe(r io.Reader) (ch byte, p []byte, err error) {
+	var hdr [5]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > MaxFrame {
+		return 0, nil, errFrameSize
+	}
+	p = make([]byte, n)
+	if _, err = io.ReadFull(r, p); err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return hdr[0], p, nil
+}
+
+// term3f is term3 for framed mode. It returns the exit
+// status of the remote cmd.
+func term3f(rw io.ReadWriter) (status int, err error) {
+	f := &framer{w: rw}
+	go func() {
+		verb("open: stdin|net")
+		defer verb("close: stdin|net")
+		if _, err := io.Copy(&chanWriter{f, chStdin}, os.Stdin); err != nil {
+			printerr("stdin|net", err)
+		}
+		f.Frame(chStdin, nil)
+	}()
+
+	verb("open: net|stdout")
+	defer verb("close: net|stdout")
+	for {
+		ch, p, err := readframe(rw)
+		if err == io.EOF {
+			return 1, fmt.Errorf("hangup before exit status")
+		}
+		if err != nil {
+			return 1, err
+		}
+		switch ch {
+		case chStdout:
+			_, err = os.Stdout.Write(p)
+		case chStderr:
+			_, err = os.Stderr.Write(p)
+		case chExit:
+			status, err := strconv.Atoi(string(p))
+			if err != nil {
+				return 1, fmt.Errorf("bad exit status: %q", p)
+			}
+			return status, nil
+		}
+		if err != nil {
+			return 1, err
+		}
+	}
+}
+
+// errFramed is returned when -f is combined with -m or cmd
+var errFramed = fmt.Errorf("-f can't be used with -m or cmd")
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// remote plays the listening side of a framed connection: it
+// discards what term3f sends and replies with the given frames
+func remote(frames ...[]byte) net.Conn {
+	c0, c1 := net.Pipe()
+	go io.Copy(ioutil.Discard, c1)
+	go func() {
+		f := &framer{w: c1}
+		for _, p := range frames {
+			f.Frame(p[0], p[1:])
+		}
+		c1.Close()
+	}()
+	return c0
+}
+
+func TestTerm3fExit(t *testing.T) {
+	for _, v := range []struct {
+		frames [][]byte
+		status int
+		ok     bool
+	}{
+		{[][]byte{{chExit, '0'}}, 0, true},
+		{[][]byte{{chExit, '4', '2'}}, 42, true},
+		{[][]byte{{chStderr}, {chExit, '3'}}, 3, true},
+		{[][]byte{{chExit, 'x'}}, 1, false},
+		{[][]byte{{chExit}}, 1, false},
+		{nil, 1, false},
+	} {
+		conn := remote(v.frames...)
+		status, err := term3f(conn)
+		conn.Close()
+		if status != v.status || (err == nil) != v.ok {
+			t.Logf("%q: have %d %v, want %d ok=%v", v.frames, status, err, v.status, v.ok)
+			t.Fail()
+		}
+	}
+}
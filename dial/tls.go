@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// Exit codes for connection failures
+const (
+	ExitConnect = 2 // the remote host could not be reached
+	ExitVerify  = 3 // the remote host's certificate was rejected
+)
+
+// pinError is returned when the leaf certificate's
+// fingerprint doesn't match the pinned fingerprint
+type pinError struct {
+	have, want string
+}
+
+func (e *pinError) Error() string {
+	return fmt.Sprintf("tls: pinned fingerprint mismatch: have %s, want %s", e.have, e.want)
+}
+
+// tlsconfig returns the client configuration for srv. The server
+// is verified against the system pool, or ca if it's not empty.
+// Pair optionally names a client certificate: cert.pem,key.pem.
+func tlsconfig(srv, sni, ca, pair, pin string) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: sni}
+	if conf.ServerName == "" {
+		host, _, err := net.SplitHostPort(srv)
+		if err != nil {
+			return nil, err
+		}
+		conf.ServerName = host
+	}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificates in %s", ca)
+		}
+	}
+	if pair != "" {
+		files := strings.Split(pair, ",")
+		if len(files) != 2 {
+			return nil, fmt.Errorf("tls: want cert.pem,key.pem: have %q", pair)
+		}
+		cert, err := tls.LoadX509KeyPair(files[0], files[1])
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if pin != "" {
+		want := strings.ToLower(strings.Replace(pin, ":", "", -1))
+		conf.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return &pinError{"none", want}
+			}
+			sum := sha256.Sum256(raw[0])
+			if have := hex.EncodeToString(sum[:]); have != want {
+				return &pinError{have, want}
+			}
+			return nil
+		}
+	}
+	return conf, nil
+}
+
+// Timeouts bounding how long dialtls waits for the remote host
+// to answer the call and to complete the tls handshake.
+var (
+	DialTimeout      = 30 * time.Second
+	HandshakeTimeout = 10 * time.Second
+)
+
+// dialtls connects to srv and completes the tls handshake. The
+// returned exit code distinguishes connect and verify failures.
+func dialtls(network, srv string, conf *tls.Config) (net.Conn, int, error) {
+	fd, err := net.DialTimeout(network, srv, DialTimeout)
+	if err != nil {
+		return nil, ExitConnect, err
+	}
+	t := tls.Client(fd, conf)
+	t.SetDeadline(time.Now().Add(HandshakeTimeout))
+	if err := t.Handshake(); err != nil {
+		fd.Close()
+		if verifyerr(err) {
+			return nil, ExitVerify, err
+		}
+		return nil, ExitConnect, err
+	}
+	t.SetDeadline(time.Time{})
+	st := t.ConnectionState()
+	sum := sha256.Sum256(st.PeerCertificates[0].Raw)
+	verb("tls: subject:", st.PeerCertificates[0].Subject)
+	verb("tls: sha256:", hex.EncodeToString(sum[:]))
+	return t, 0, nil
+}
+
+func verifyerr(err error) bool {
+	var (
+		pe *pinError
+		ua x509.UnknownAuthorityError
+		he x509.HostnameError
+		ci x509.CertificateInvalidError
+	)
+	return errors.As(err, &pe) || errors.As(err, &ua) ||
+		errors.As(err, &he) || errors.As(err, &ci)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialTLSHandshakeTimeout(t *testing.T) {
+	defer func(d time.Duration) { HandshakeTimeout = d }(HandshakeTimeout)
+	HandshakeTimeout = 100 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// accept the call but never answer the handshake
+		fd, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+		time.Sleep(5 * time.Second)
+	}()
+
+	start := time.Now()
+	fd, code, err := dialtls("tcp", ln.Addr().String(), &tls.Config{ServerName: "localhost"})
+	if err == nil {
+		fd.Close()
+		t.Fatal("handshake with a silent server succeeded")
+	}
+	if code != ExitConnect {
+		t.Logf("have exit %d, want %d: %v", code, ExitConnect, err)
+		t.Fail()
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Logf("handshake gave up after %v, want about %v", d, HandshakeTimeout)
+		t.Fail()
+	}
+}
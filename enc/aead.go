@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ErrAuth is returned when a ciphertext fails authentication
+var ErrAuth = errors.New("authentication failed: ciphertext is corrupt or the key is wrong")
+
+// AEAD is an authenticated cipher and its nonce. If Prefix is
+// set, the nonce is written before the ciphertext. AD is the
+// header, which is authenticated along with the ciphertext.
+type AEAD struct {
+	cipher.AEAD
+	Nonce  []byte
+	Prefix bool
+	AD     []byte
+}
+
+// NewAEAD returns the authenticated cipher for std and mode,
+// or nil if the mode doesn't authenticate.
+func NewAEAD(std Std, mode Mode, key []byte) (*AEAD, error) {
+	var (
+		a   cipher.AEAD
+		err error
+	)
+	switch {
+	case std == "chacha20" && mode == "poly1305":
+		a, err = chacha20poly1305.New(key)
+	case std == "chacha20":
+		return nil, fmt.Errorf("chacha20: mode not found: %s", mode)
+	case mode == "gcm":
+		block, err := std.SetCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		a, err = cipher.NewGCM(block)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if Role == "dec" && header == nil && args.i == "" {
+		return &AEAD{AEAD: a, Prefix: true}, nil
+	}
+	nonce, prefix := mustnonce(a.NonceSize())
+	return &AEAD{AEAD: a, Nonce: nonce, Prefix: prefix}, nil
+}
+
+// authenticated reports whether the mode of alg authenticates
+func authenticated(alg string) bool {
+	v := strings.Split(alg, "/")
+	return len(v) == 3 && (v[1] == "gcm" || v[1] == "poly1305")
+}
+
+// mustnonce returns the nonce given with -i, or a random nonce
+// if -i is empty. Prefix reports whether the nonce must be written
+// before the ciphertext because there is no header to hold it.
+func mustnonce(size int) (nonce []byte, prefix bool) {
+	nonce = musthex(args.i)
+	if len(nonce) == 0 {
+		nonce = make([]byte, size)
+		_, err := rand.Read(nonce)
+		dieon(err)
+		prefix = header == nil
+	}
+	if len(nonce) != size {
+		dieon(fmt.Errorf("iv: bad length: %d: need nonce size: %d", len(nonce), size))
+	}
+	if header != nil {
+		header.IV = nonce
+	}
+	return nonce, prefix
+}
+
+// seal encrypts and authenticates the plaintext read from r
+func seal(w io.Writer, r io.Reader, a *AEAD) (int, error) {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	var out []byte
+	if a.Prefix {
+		out = append(out, a.Nonce...)
+	}
+	return w.Write(a.Seal(out, a.Nonce, msg, a.AD))
+}
+
+// open authenticates and decrypts the ciphertext read from r.
+// Nothing is written to w unless authentication succeeds.
+func open(w io.Writer, r io.Reader, a *AEAD) (int, error) {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	nonce := a.Nonce
+	if a.Prefix {
+		if len(msg) < a.NonceSize() {
+			return 0, ErrAuth
+		}
+		nonce, msg = msg[:a.NonceSize()], msg[a.NonceSize():]
+	}
+	p, err := a.Open(msg[:0], nonce, msg, a.AD)
+	if err != nil {
+		return 0, ErrAuth
+	}
+	return w.Write(p)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func testaead(t *testing.T, prefix bool) *AEAD {
+	t.Helper()
+	key := make([]byte, chacha20poly1305.KeySize)
+	rand.Read(key)
+	a, err := chacha20poly1305.New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, a.NonceSize())
+	rand.Read(nonce)
+	return &AEAD{AEAD: a, Nonce: nonce, Prefix: prefix}
+}
+
+// records splits a sealed stream into its records
+func records(t *testing.T, p []byte, a *AEAD) (prefix []byte, recs [][]byte) {
+	t.Helper()
+	if a.Prefix {
+		prefix, p = p[:a.NonceSize()], p[a.NonceSize():]
+	}
+	for len(p) > 0 {
+		n := recordHeader + int(binary.BigEndian.Uint32(p[9:]))
+		recs = append(recs, p[:n])
+		p = p[n:]
+	}
+	return prefix, recs
+}
+
+// sealn returns the chunked ciphertext of n bytes of plaintext
+func sealn(t *testing.T, a *AEAD, n int) (plain, sealed []byte) {
+	t.Helper()
+	plain = make([]byte, n)
+	rand.Read(plain)
+	var b bytes.Buffer
+	if _, err := sealchunks(&b, bytes.NewReader(plain), a); err != nil {
+		t.Fatal(err)
+	}
+	return plain, b.Bytes()
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	for _, prefix := range []bool{false, true} {
+		for _, n := range []int{0, 1, ChunkSize - 1, ChunkSize, 3*ChunkSize + 7} {
+			a := testaead(t, prefix)
+			plain, sealed := sealn(t, a, n)
+			var b bytes.Buffer
+			if _, err := openchunks(&b, bytes.NewReader(sealed), a); err != nil {
+				t.Logf("%d bytes: %s", n, err)
+				t.Fail()
+				continue
+			}
+			if !bytes.Equal(b.Bytes(), plain) {
+				t.Logf("%d bytes: plaintext differs", n)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestChunkTamper(t *testing.T) {
+	a := testaead(t, false)
+	_, sealed := sealn(t, a, 3*ChunkSize+7)
+	_, recs := records(t, sealed, a)
+	if len(recs) < 3 {
+		t.Fatalf("have %d records, want at least 3", len(recs))
+	}
+	join := func(recs ...[]byte) []byte {
+		return bytes.Join(recs, nil)
+	}
+	flip := func(p []byte, i int) []byte {
+		p = append([]byte(nil), p...)
+		p[i] ^= 1
+		return p
+	}
+	last := recs[len(recs)-1]
+	for _, v := range []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"swapped", join(recs[1], recs[0], recs[2])},
+		{"replayed", join(recs[0], recs[0], recs[1])},
+		{"dropped", join(append([][]byte{recs[0]}, recs[2:]...)...)},
+		{"no last record", join(recs[:len(recs)-1]...)},
+		{"cut short", sealed[:len(sealed)-1]},
+		{"cut header", sealed[:len(sealed)-len(last)+4]},
+		{"trailing data", join(sealed, []byte("x"))},
+		{"record after last", join(sealed, last)},
+		{"flipped ciphertext", flip(sealed, recordHeader+1)},
+		{"flipped seq", flip(sealed, 7)},
+		{"flipped last flag", flip(sealed, len(sealed)-len(last)+8)},
+		{"huge length", flip(sealed, 9)},
+	} {
+		var b bytes.Buffer
+		_, err := openchunks(&b, bytes.NewReader(v.in), a)
+		if err == nil {
+			t.Logf("%s: no error", v.name)
+			t.Fail()
+		}
+	}
+
+	// records verified before the damage are still written
+	var b bytes.Buffer
+	_, err := openchunks(&b, bytes.NewReader(join(recs[:2]...)), a)
+	if err != ErrTruncated || b.Len() != 2*ChunkSize {
+		t.Logf("truncated: have %v after %d bytes, want %v after %d", err, b.Len(), ErrTruncated, 2*ChunkSize)
+		t.Fail()
+	}
+}
+
+func TestChunkWrongKey(t *testing.T) {
+	a := testaead(t, true)
+	_, sealed := sealn(t, a, 100)
+	b := testaead(t, true)
+	if _, err := openchunks(ioutil.Discard, bytes.NewReader(sealed), b); err != ErrAuth {
+		t.Logf("have %v, want %v", err, ErrAuth)
+		t.Fail()
+	}
+}
+
+func TestChunkHeader(t *testing.T) {
+	a := testaead(t, false)
+	a.AD = []byte("ENC\x01\x02header")
+	_, sealed := sealn(t, a, 2*ChunkSize)
+	if _, err := openchunks(ioutil.Discard, bytes.NewReader(sealed), a); err != nil {
+		t.Fatalf("same header: %v", err)
+	}
+	for _, ad := range []string{"", "ENC\x01\x00header", "ENC\x01\x02headex"} {
+		b := *a
+		b.AD = []byte(ad)
+		if _, err := openchunks(ioutil.Discard, bytes.NewReader(sealed), &b); err != ErrAuth {
+			t.Logf("header %q: have %v, want %v", ad, err, ErrAuth)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKDFHeader(t *testing.T) {
+	kdf, err := NewKDF(KDFScrypt, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundtrip(t, &Header{Flags: FlagKDF, Alg: "aes/ctr", IV: make([]byte, 16), KDF: kdf})
+	truncated(t, &Header{Alg: "aes/gcm", IV: make([]byte, 12), KDF: &KDF{Name: KDFPBKDF2, Salt: make([]byte, SaltSize), Params: []uint32{1}}})
+}
+
+func TestKDFCheck(t *testing.T) {
+	for _, v := range []struct {
+		k  KDF
+		ok bool
+	}{
+		{KDF{Name: KDFScrypt, Params: []uint32{15, 8, 1}}, true},
+		{KDF{Name: KDFScrypt, Params: []uint32{MaxScryptCost, 8, 4}}, true},
+		{KDF{Name: KDFScrypt, Params: []uint32{MaxScryptCost + 1, 8, 1}}, false},
+		{KDF{Name: KDFScrypt, Params: []uint32{0, 8, 1}}, false},
+		{KDF{Name: KDFScrypt, Params: []uint32{15, 8, 5}}, false},
+		{KDF{Name: KDFScrypt, Params: []uint32{15, 1 << 31, 1 << 31}}, false},
+		{KDF{Name: KDFScrypt, Params: []uint32{15, 8}}, false},
+		{KDF{Name: KDFPBKDF2, Params: []uint32{PBKDF2Cost}}, true},
+		{KDF{Name: KDFPBKDF2, Params: []uint32{MaxPBKDF2Cost + 1}}, false},
+		{KDF{Name: KDFPBKDF2, Params: []uint32{0}}, false},
+		{KDF{Name: "md5", Params: []uint32{1}}, false},
+	} {
+		if err := v.k.check(); (err == nil) != v.ok {
+			t.Logf("%s %v: have %v, want ok=%v", v.k.Name, v.k.Params, err, v.ok)
+			t.Fail()
+		}
+		if v.ok {
+			continue
+		}
+		if _, err := v.k.Derive([]byte("pass"), 32); err == nil {
+			t.Logf("%s %v: derived a key from bad parameters", v.k.Name, v.k.Params)
+			t.Fail()
+		}
+	}
+}
+
+func TestKDFDerive(t *testing.T) {
+	k := &KDF{Name: KDFPBKDF2, Salt: []byte("salt"), Params: []uint32{1000}}
+	k1, err := k.Derive([]byte("pass"), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, _ := k.Derive([]byte("pass"), 32)
+	k3, _ := k.Derive([]byte("ssap"), 32)
+	if len(k1) != 32 || !bytes.Equal(k1, k2) || bytes.Equal(k1, k3) {
+		t.Logf("derive: %x %x %x", k1, k2, k3)
+		t.Fail()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestRecipientHeader(t *testing.T) {
+	roundtrip(t, &Header{Flags: FlagRecipients, Alg: "aes/gcm", IV: make([]byte, 12), Recipients: []*Stanza{
+		{Type: StanzaX25519, Body: bytes.Repeat([]byte{1}, 80)},
+		{Type: "rsa", Body: bytes.Repeat([]byte{2}, 512)},
+	}})
+	truncated(t, &Header{Alg: "aes/gcm", Recipients: []*Stanza{{Type: StanzaX25519, Body: make([]byte, 80)}}})
+
+	var b bytes.Buffer
+	h := &Header{Alg: "aes/gcm", Recipients: make([]*Stanza, MaxRecipients+1)}
+	if _, err := h.WriteTo(&b); err != ErrRecipients {
+		t.Logf("%d recipients: have %v, want %v", MaxRecipients+1, err, ErrRecipients)
+		t.Fail()
+	}
+}
+
+func TestX25519Wrap(t *testing.T) {
+	id := X25519Identity(make([]byte, curve25519.ScalarSize))
+	rand.Read(id)
+	pk, err := curve25519.X25519(id, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	s, err := X25519Recipient(pk).Wrap(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stanza must survive the header
+	var b bytes.Buffer
+	(&Header{Alg: "aes/gcm", Recipients: []*Stanza{s}}).WriteTo(&b)
+	h, err := ReadHeader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := id.Unwrap(h.Recipients[0])
+	if err != nil || !bytes.Equal(have, key) {
+		t.Logf("unwrap: have %x %v, want %x", have, err, key)
+		t.Fail()
+	}
+
+	other := X25519Identity(make([]byte, curve25519.ScalarSize))
+	rand.Read(other)
+	if _, err := other.Unwrap(s); err != ErrNoStanza {
+		t.Logf("wrong identity: have %v, want %v", err, ErrNoStanza)
+		t.Fail()
+	}
+	s.Body[len(s.Body)-1] ^= 1
+	if _, err := id.Unwrap(s); err != ErrNoStanza {
+		t.Logf("tampered stanza: have %v, want %v", err, ErrNoStanza)
+		t.Fail()
+	}
+}
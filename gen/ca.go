@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// extKeyUsages maps the names accepted by -eku
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"any":    x509.ExtKeyUsageAny,
+	"server": x509.ExtKeyUsageServerAuth,
+	"client": x509.ExtKeyUsageClientAuth,
+	"code":   x509.ExtKeyUsageCodeSigning,
+	"email":  x509.ExtKeyUsageEmailProtection,
+	"time":   x509.ExtKeyUsageTimeStamping,
+	"ocsp":   x509.ExtKeyUsageOCSPSigning,
+}
+
+func parseEKU(list string) (eku []x509.ExtKeyUsage, err error) {
+	for _, name := range strings.Split(list, ",") {
+		if name == "" {
+			continue
+		}
+		u, ok := extKeyUsages[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown extended key usage: %q", name)
+		}
+		eku = append(eku, u)
+	}
+	return eku, nil
+}
+
+// Issuer is the CA that signs the new certificate. Chain holds
+// the certificates after the first in the issuer's file.
+type Issuer struct {
+	Cert  *x509.Certificate
+	Chain []*x509.Certificate
+	Key   crypto.Signer
+}
+
+// loadIssuer reads the issuer's certificate, and its private key.
+// Pass decrypts an encrypted key.
+func loadIssuer(certFile, keyFile string, pass []byte) (*Issuer, error) {
+	certs, err := readCerts(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if !certs[0].IsCA {
+		return nil, fmt.Errorf("%s: not a CA certificate", certFile)
+	}
+	key, err := readKey(keyFile, pass)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{Cert: certs[0], Chain: certs[1:], Key: key}, nil
+}
+
+func readCerts(file string) (certs []*x509.Certificate, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var b *pem.Block
+		if b, data = pem.Decode(data); b == nil {
+			break
+		}
+		if b.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no certificates found", file)
+	}
+	return certs, nil
+}
+
+func readKey(file string, pass []byte) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var b *pem.Block
+		if b, data = pem.Decode(data); b == nil {
+			break
+		}
+		var key interface{}
+		switch b.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(b.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(b.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(b.Bytes)
+		case "ENCRYPTED PRIVATE KEY":
+			if pass == nil {
+				return nil, fmt.Errorf("%s: key is encrypted: set -issuerpass", file)
+			}
+			var der []byte
+			if der, err = decryptKey(b.Bytes, pass); err == nil {
+				key, err = x509.ParsePKCS8PrivateKey(der)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if s, ok := key.(crypto.Signer); ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("%s: key can't sign: %T", file, key)
+	}
+	return nil, fmt.Errorf("%s: no private key found", file)
+}
+
+// serialFile returns the file tracking the issuer's serial numbers
+func serialFile(issuerCert string) string {
+	return strings.TrimSuffix(issuerCert, ".pem") + ".srl"
+}
+
+// nextSerial returns the serial number in file and stores the
+// one after it. The file holds one hex number. If the file doesn't
+// exist, the first serial is random.
+func nextSerial(file string) (*big.Int, error) {
+	serial := new(big.Int)
+	data, err := ioutil.ReadFile(file)
+	switch {
+	case os.IsNotExist(err):
+		limit := new(big.Int).Lsh(big.NewInt(1), 63)
+		if serial, err = rand.Int(rand.Reader, limit); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if _, ok := serial.SetString(string(bytes.TrimSpace(data)), 16); !ok {
+			return nil, fmt.Errorf("%s: bad serial number: %q", file, bytes.TrimSpace(data))
+		}
+	}
+	next := new(big.Int).Add(serial, big.NewInt(1))
+	if err := ioutil.WriteFile(file, []byte(fmt.Sprintf("%X\n", next)), 0644); err != nil {
+		return nil, err
+	}
+	return serial, nil
+}
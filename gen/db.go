@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// The revocation database lists every certificate an issuer signed,
+// one per line, in the tab-separated format of openssl's index.txt:
+//
+//	status expires revoked[,reason] serial file subject
+//
+// Status is V for valid or R for revoked. Times are UTCTime, and
+// the file column is always "unknown".
+const dbTime = "060102150405Z"
+
+// Record is one certificate in the database
+type Record struct {
+	Status  byte
+	Expires time.Time
+	Revoked time.Time
+	Reason  int
+	Serial  *big.Int
+	Subject string
+}
+
+// DB is an issuer's revocation database
+type DB struct {
+	File    string
+	Records []*Record
+}
+
+// reasons are the CRL reason codes from RFC 5280
+var reasons = []string{
+	"unspecified",
+	"keyCompromise",
+	"CACompromise",
+	"affiliationChanged",
+	"superseded",
+	"cessationOfOperation",
+	"certificateHold",
+	"",
+	"removeFromCRL",
+	"privilegeWithdrawn",
+	"AACompromise",
+}
+
+var oidReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+func parseReason(s string) (int, error) {
+	for i, r := range reasons {
+		if r != "" && strings.EqualFold(r, s) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown revocation reason: %q", s)
+}
+
+// dbFile returns the database for the issuer's certificate file
+func dbFile(issuerCert string) string {
+	return strings.TrimSuffix(issuerCert, ".pem") + ".db"
+}
+
+// OpenDB reads the database in file. A missing file is empty.
+func OpenDB(file string) (*DB, error) {
+	db := &DB{File: file}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		if sc.Text() == "" {
+			continue
+		}
+		r, err := parseRecord(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		db.Records = append(db.Records, r)
+	}
+	return db, sc.Err()
+}
+
+func parseRecord(line string) (r *Record, err error) {
+	f := strings.Split(line, "\t")
+	if len(f) != 6 || len(f[0]) != 1 {
+		return nil, fmt.Errorf("bad record: %q", line)
+	}
+	r = &Record{Status: f[0][0], Subject: f[5], Serial: new(big.Int)}
+	if r.Expires, err = time.Parse(dbTime, f[1]); err != nil {
+		return nil, err
+	}
+	if f[2] != "" {
+		rev := strings.SplitN(f[2], ",", 2)
+		if r.Revoked, err = time.Parse(dbTime, rev[0]); err != nil {
+			return nil, err
+		}
+		if len(rev) == 2 {
+			if r.Reason, err = parseReason(rev[1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, ok := r.Serial.SetString(f[3], 16); !ok {
+		return nil, fmt.Errorf("bad serial: %q", f[3])
+	}
+	return r, nil
+}
+
+func (r *Record) String() string {
+	rev := ""
+	if r.Status == 'R' {
+		rev = r.Revoked.UTC().Format(dbTime)
+		if r.Reason != 0 {
+			rev += "," + reasons[r.Reason]
+		}
+	}
+	return fmt.Sprintf("%c\t%s\t%s\t%X\tunknown\t%s",
+		r.Status, r.Expires.UTC().Format(dbTime), rev, r.Serial, r.Subject)
+}
+
+// Add records a newly issued certificate
+func (db *DB) Add(c *x509.Certificate) error {
+	r := &Record{Status: 'V', Expires: c.NotAfter, Serial: c.SerialNumber, Subject: c.Subject.String()}
+	db.Records = append(db.Records, r)
+	return db.Save()
+}
+
+// Lookup returns the record for serial, or nil
+func (db *DB) Lookup(serial *big.Int) *Record {
+	for _, r := range db.Records {
+		if r.Serial.Cmp(serial) == 0 {
+			return r
+		}
+	}
+	return nil
+}
+
+// Revoke marks serial revoked for reason at t
+func (db *DB) Revoke(serial *big.Int, reason int, t time.Time) error {
+	r := db.Lookup(serial)
+	if r == nil {
+		return fmt.Errorf("%s: serial not found: %X", db.File, serial)
+	}
+	if r.Status == 'R' {
+		return fmt.Errorf("%s: serial already revoked: %X", db.File, serial)
+	}
+	r.Status, r.Revoked, r.Reason = 'R', t, reason
+	return db.Save()
+}
+
+// Save writes the database
+func (db *DB) Save() error {
+	var b bytes.Buffer
+	for _, r := range db.Records {
+		fmt.Fprintln(&b, r)
+	}
+	return ioutil.WriteFile(db.File, b.Bytes(), 0644)
+}
+
+// Revoked returns the revoked certificates for a CRL
+func (db *DB) Revoked() (list []pkix.RevokedCertificate) {
+	for _, r := range db.Records {
+		if r.Status != 'R' {
+			continue
+		}
+		rc := pkix.RevokedCertificate{SerialNumber: r.Serial, RevocationTime: r.Revoked}
+		if r.Reason != 0 {
+			v, _ := asn1.Marshal(asn1.Enumerated(r.Reason))
+			rc.Extensions = []pkix.Extension{{Id: oidReasonCode, Value: v}}
+		}
+		list = append(list, rc)
+	}
+	return list
+}
+
+// parseSerial reads a serial number in hex, or the serial of the
+// certificate in the named file
+func parseSerial(s string) (*big.Int, error) {
+	if _, err := os.Stat(s); err == nil {
+		certs, err := readCerts(s)
+		if err != nil {
+			return nil, err
+		}
+		return certs[0].SerialNumber, nil
+	}
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		return nil, fmt.Errorf("not a file or hex serial: %q", s)
+	}
+	return n, nil
+}
@@ -2,13 +2,35 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Generate a self-signed X.509 certificate for a TLS server. Outputs to
-// 'cert.pem' and 'key.pem' and will overwrite existing files.
+// Generate an X.509 certificate and key. The certificate is self-signed,
+// or signed by the CA given with -issuer and -issuerkey, and may itself be
+// a CA. Outputs to 'cert.pem' and 'key.pem', or the files named by -cert
+// and -key, and will overwrite existing files. With -csr, gen writes a
+// certificate signing request for an external CA instead of a certificate.
+//
+// A throwaway PKI for mTLS:
+//
+//	gen -ca -common root -cert root.pem -key root-key.pem
+//	gen -ca -common int -issuer root.pem -issuerkey root-key.pem -pathlen 0 -cert int.pem -key int-key.pem
+//	gen -n localhost,127.0.0.1 -issuer int.pem -issuerkey int-key.pem -bundle -cert srv.pem -key srv-key.pem
+//	gen -common alice -eku client -issuer int.pem -issuerkey int-key.pem -bundle -cert alice.pem -key alice-key.pem
+//
+// Revoke alice, publish a crl, and answer OCSP requests behind listen.
+// Gen records each certificate an issuer signs in the issuer's database.
+//
+//	gen -issuer int.pem -revoke alice.pem -reason keyCompromise
+//	gen -issuer int.pem -issuerkey int-key.pem -crl int.crl
+//	listen :8080 gen -issuer int.pem -issuerkey int-key.pem -ocsp -
+//
+// An Ed25519 key, encrypted with the passphrase in $pw, and a request:
+//
+//	pw=secret gen -e Ed25519 -pass pw -n example.com -org Example -c US -st CA -l Oakland -csr example.csr
 
 package main
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
@@ -20,20 +42,47 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 )
 
 var (
-	host       = flag.String("n", "", "Comma-separated hostnames and IPs to generate a certificate for")
+	host       = flag.String("n", "", "Comma-separated hostnames, IPs, emails and URIs to generate a certificate for")
 	validFrom  = flag.String("s", "", "Creation date formatted as Jan 1 15:04:05 2011")
 	validFor   = flag.Duration("d", 365*24*time.Hour, "Duration that certificate is valid for")
-	rsaBits    = flag.Int("r", 4096, "Length of RSA key to generate. Ignored if -ecdsa-curve is set")
-	ecdsaCurve = flag.String("e", "", "ECDSA curve to use to generate a key. Valid values are P224, P256, P384, P521")
+	rsaBits    = flag.Int("r", 4096, "Length of RSA key to generate. Ignored if -e is set")
+	ecdsaCurve = flag.String("e", "", "ECDSA curve or Ed25519 to use to generate a key. Valid values are P224, P256, P384, P521, Ed25519")
 	isCA       = flag.Bool("ca", false, "whether this cert should be its own Certificate Authority")
-	org        = flag.String("org", "Duddy. Buddy Inc", "Organization")
-	common     = flag.String("common", "Dafty Duck", "Common name")
+	org        = flag.String("org", "", "Organization")
+	orgUnit    = flag.String("ou", "", "Organizational unit")
+	country    = flag.String("c", "", "Country")
+	locality   = flag.String("l", "", "Locality or city")
+	province   = flag.String("st", "", "State or province")
+	common     = flag.String("common", "", "Common name (default: the first of -n)")
+	issuer     = flag.String("issuer", "", "CA certificate to sign with instead of self-signing")
+	issuerKey  = flag.String("issuerkey", "", "Private key of the -issuer CA")
+	eku        = flag.String("eku", "", "Comma-separated extended key usages: server, client, code, email, time, ocsp, any. Defaults to server, or none with -ca")
+	pathLen    = flag.Int("pathlen", -1, "Maximum number of CAs below a -ca certificate. Unlimited if negative")
+	serialPath = flag.String("serial", "", "File tracking the issuer's next serial number (default: the -issuer file with .srl)")
+	bundle     = flag.Bool("bundle", false, "Append the issuer and its chain to the certificate")
+	certPath   = flag.String("cert", "cert.pem", "Output certificate file")
+	keyPath    = flag.String("key", "key.pem", "Output private key file")
+	outPath    = flag.String("out", "", "Write the certificate, its chain, and the key to one pem file instead of -cert and -key")
+	csrPath    = flag.String("csr", "", "Write a certificate signing request to this file instead of a certificate")
+	pkcs8      = flag.Bool("pkcs8", false, "Write the key as PKCS#8. Ed25519 and encrypted keys are always PKCS#8")
+	keyPass    = flag.String("pass", "", "Encrypt the key with the passphrase in this environment variable")
+	issuerPass = flag.String("issuerpass", "", "Decrypt the -issuerkey with the passphrase in this environment variable")
+
+	dbPath       = flag.String("db", "", "Revocation database of the issuer's certificates (default: the -issuer file with .db)")
+	revokeSerial = flag.String("revoke", "", "Revoke the certificate with this hex serial, or in this file, instead of generating one")
+	revokeReason = flag.String("reason", "", "Reason for -revoke: keyCompromise, CACompromise, affiliationChanged, superseded, cessationOfOperation, ...")
+	crlPath      = flag.String("crl", "", "Write a crl signed by the issuer to this file instead of generating a certificate")
+	crlFor       = flag.Duration("crlfor", 7*24*time.Hour, "Duration until the next update of a -crl")
+	ocspAddr     = flag.String("ocsp", "", "Run an OCSP responder for the issuer on this address, or - for standard input and output")
+	ocspURL      = flag.String("ocspurl", "", "OCSP responder url to put in issued certificates")
+	crlURL       = flag.String("crlurl", "", "CRL distribution point url to put in issued certificates")
 )
 
 func publicKey(priv interface{}) interface{} {
@@ -42,11 +91,51 @@ func publicKey(priv interface{}) interface{} {
 		return &k.PublicKey
 	case *ecdsa.PrivateKey:
 		return &k.PublicKey
+	case ed25519.PrivateKey:
+		return k.Public()
 	default:
 		return nil
 	}
 }
 
+// subject returns the subject named by the flags
+func subject(hosts []string) pkix.Name {
+	var name pkix.Name
+	for _, f := range []struct {
+		dst *[]string
+		v   string
+	}{
+		{&name.Organization, *org},
+		{&name.OrganizationalUnit, *orgUnit},
+		{&name.Country, *country},
+		{&name.Locality, *locality},
+		{&name.Province, *province},
+	} {
+		if f.v != "" {
+			*f.dst = []string{f.v}
+		}
+	}
+	name.CommonName = *common
+	if name.CommonName == "" && len(hosts) > 0 {
+		name.CommonName = hosts[0]
+	}
+	return name
+}
+
+func writePEM(file string, perm os.FileMode, blocks ...*pem.Block) error {
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		if err := pem.Encode(out, b); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
 func pemBlockForKey(priv interface{}) *pem.Block {
 	switch k := priv.(type) {
 	case *rsa.PrivateKey:
@@ -66,12 +155,66 @@ func pemBlockForKey(priv interface{}) *pem.Block {
 func main() {
 	flag.Parse()
 
-	if len(*host) == 0 {
+	usages, err := parseEKU(*eku)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *eku == "" && !*isCA {
+		usages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	var pass []byte
+	if *keyPass != "" {
+		if pass, err = passphrase(*keyPass); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var ca *Issuer
+	if (*issuer != "" || *issuerKey != "") && *revokeSerial == "" {
+		if *issuer == "" || *issuerKey == "" {
+			log.Fatalf("-issuer and -issuerkey go together")
+		}
+		var ipass []byte
+		if *issuerPass != "" {
+			if ipass, err = passphrase(*issuerPass); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if ca, err = loadIssuer(*issuer, *issuerKey, ipass); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var db *DB
+	if *dbPath == "" && *issuer != "" {
+		*dbPath = dbFile(*issuer)
+	}
+	if *dbPath != "" {
+		if db, err = OpenDB(*dbPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch {
+	case *revokeSerial != "" && db == nil:
+		log.Fatalf("-revoke needs -issuer or -db")
+	case *revokeSerial != "":
+		revoke(db)
+		return
+	case (*crlPath != "" || *ocspAddr != "") && ca == nil:
+		log.Fatalf("-crl and -ocsp need -issuer and -issuerkey")
+	case *crlPath != "":
+		writeCRL(db, ca)
+		return
+	case *ocspAddr != "":
+		serveOCSP(db, ca)
+		return
+	}
+
+	if len(*host) == 0 && hasUsage(usages, x509.ExtKeyUsageServerAuth) && *csrPath == "" {
 		log.Fatalf("Missing -n")
 	}
 
 	var priv interface{}
-	var err error
 	switch *ecdsaCurve {
 	case "":
 		priv, err = rsa.GenerateKey(rand.Reader, *rsaBits)
@@ -83,6 +226,8 @@ func main() {
 		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
 	case "P521":
 		priv, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "Ed25519":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
 	default:
 		fmt.Fprintf(os.Stderr, "Unrecognized elliptic curve: %q", *ecdsaCurve)
 		os.Exit(1)
@@ -90,6 +235,51 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to generate private key: %s", err)
 	}
+	keyBlock, err := marshalKey(priv, *pkcs8, pass)
+	if err != nil {
+		log.Fatalf("failed to marshal private key: %s", err)
+	}
+
+	var hosts []string
+	for _, h := range strings.Split(*host, ",") {
+		if h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	san := &x509.Certificate{}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			san.IPAddresses = append(san.IPAddresses, ip)
+		} else if u, err := url.Parse(h); err == nil && u.Scheme != "" && u.Host != "" {
+			san.URIs = append(san.URIs, u)
+		} else if strings.Contains(h, "@") {
+			san.EmailAddresses = append(san.EmailAddresses, h)
+		} else {
+			san.DNSNames = append(san.DNSNames, h)
+		}
+	}
+
+	if *csrPath != "" {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:        subject(hosts),
+			DNSNames:       san.DNSNames,
+			IPAddresses:    san.IPAddresses,
+			EmailAddresses: san.EmailAddresses,
+			URIs:           san.URIs,
+		}, priv)
+		if err != nil {
+			log.Fatalf("Failed to create certificate request: %s", err)
+		}
+		if err := writePEM(*csrPath, 0644, &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}); err != nil {
+			log.Fatalf("failed to write %s: %s", *csrPath, err)
+		}
+		log.Printf("created %s\n", *csrPath)
+		if err := writePEM(*keyPath, 0600, keyBlock); err != nil {
+			log.Fatalf("failed to write %s: %s", *keyPath, err)
+		}
+		log.Printf("created %s\n", *keyPath)
+		return
+	}
 
 	var notBefore time.Time
 	if len(*validFrom) == 0 {
@@ -103,59 +293,108 @@ func main() {
 	}
 	notAfter := notBefore.Add(*validFor)
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	var serialNumber *big.Int
+	if ca != nil || *serialPath != "" {
+		if *serialPath == "" {
+			*serialPath = serialFile(*issuer)
+		}
+		serialNumber, err = nextSerial(*serialPath)
+	} else {
+		serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+		serialNumber, err = rand.Int(rand.Reader, serialNumberLimit)
+	}
 	if err != nil {
 		log.Fatalf("failed to generate serial number: %s", err)
 	}
 
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{*org},
-			CommonName:   *common,
-		},
-		NotBefore: notBefore,
-		NotAfter:  notAfter,
-
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		Subject:      subject(hosts),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           usages,
 		BasicConstraintsValid: true,
-	}
 
-	hosts := strings.Split(*host, ",")
-	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
-		} else {
-			template.DNSNames = append(template.DNSNames, h)
-		}
+		DNSNames:       san.DNSNames,
+		IPAddresses:    san.IPAddresses,
+		EmailAddresses: san.EmailAddresses,
+		URIs:           san.URIs,
+	}
+	if *ocspURL != "" {
+		template.OCSPServer = []string{*ocspURL}
+	}
+	if *crlURL != "" {
+		template.CRLDistributionPoints = []string{*crlURL}
+	}
+	if _, ok := priv.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
 	}
 
 	if *isCA {
 		template.IsCA = true
-		template.KeyUsage |= x509.KeyUsageCertSign
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+		if *pathLen >= 0 {
+			template.MaxPathLen = *pathLen
+			template.MaxPathLenZero = *pathLen == 0
+		}
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
+	parent, signer := &template, priv
+	if ca != nil {
+		parent, signer = ca.Cert, ca.Key
+		if notAfter.Truncate(time.Second).After(ca.Cert.NotAfter) {
+			log.Printf("warning: certificate outlives its issuer on %s", ca.Cert.NotAfter)
+		}
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent, publicKey(priv), signer)
 	if err != nil {
 		log.Fatalf("Failed to create certificate: %s", err)
 	}
 
-	certOut, err := os.Create("cert.pem")
-	if err != nil {
-		log.Fatalf("failed to open cert.pem for writing: %s", err)
+	if ca != nil {
+		c, err := x509.ParseCertificate(derBytes)
+		if err == nil {
+			err = db.Add(c)
+		}
+		if err != nil {
+			log.Fatalf("failed to record certificate in %s: %s", db.File, err)
+		}
 	}
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	certOut.Close()
-	log.Print("created cert.pem\n")
 
-	keyOut, err := os.OpenFile("key.pem", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Print("failed to open key.pem for writing:", err)
+	certs := []*pem.Block{{Type: "CERTIFICATE", Bytes: derBytes}}
+	if ca != nil && (*bundle || *outPath != "") {
+		for _, c := range append([]*x509.Certificate{ca.Cert}, ca.Chain...) {
+			certs = append(certs, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+		}
+	}
+
+	if *outPath != "" {
+		if err := writePEM(*outPath, 0600, append(certs, keyBlock)...); err != nil {
+			log.Fatalf("failed to write %s: %s", *outPath, err)
+		}
+		log.Printf("created %s serial %X\n", *outPath, serialNumber)
+		return
+	}
+
+	if err := writePEM(*certPath, 0644, certs...); err != nil {
+		log.Fatalf("failed to write %s: %s", *certPath, err)
+	}
+	log.Printf("created %s serial %X\n", *certPath, serialNumber)
+
+	if err := writePEM(*keyPath, 0600, keyBlock); err != nil {
+		log.Printf("failed to write %s: %s", *keyPath, err)
 		return
 	}
-	pem.Encode(keyOut, pemBlockForKey(priv))
-	keyOut.Close()
-	log.Print("created key.pem\n")
+	log.Printf("created %s\n", *keyPath)
+}
+
+func hasUsage(list []x509.ExtKeyUsage, u x509.ExtKeyUsage) bool {
+	for _, v := range list {
+		if v == u {
+			return true
+		}
+	}
+	return false
 }
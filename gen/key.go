@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Encrypted keys are PKCS#8 EncryptedPrivateKeyInfo using PBES2 with
+// PBKDF2/HMAC-SHA256 and AES-256-CBC, as written by openssl pkcs8 -v2
+const (
+	KeyIterations = 310000
+	KeySaltSize   = 16
+)
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// ErrPassphrase is returned when an encrypted key doesn't decrypt
+var ErrPassphrase = errors.New("encrypted key: wrong passphrase or corrupt key")
+
+type encryptedKey struct {
+	Algo pkix.AlgorithmIdentifier
+	Data []byte
+}
+
+type pbes2Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Cipher pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// encryptKey wraps a PKCS#8 key in an ENCRYPTED PRIVATE KEY block
+func encryptKey(der, pass []byte) (*pem.Block, error) {
+	salt := make([]byte, KeySaltSize)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(pbkdf2.Key(pass, salt, KeyIterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(append([]byte(nil), der...), make([]byte, pad)...)
+	for i := len(der); i < len(data); i++ {
+		data[i] = byte(pad)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdf, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: KeyIterations,
+		PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivder, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KDF:    pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		Cipher: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivder}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	b, err := asn1.Marshal(encryptedKey{
+		Algo: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		Data: data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: b}, nil
+}
+
+// decryptKey returns the PKCS#8 key in an ENCRYPTED PRIVATE KEY block
+func decryptKey(der, pass []byte) ([]byte, error) {
+	var (
+		ek     encryptedKey
+		params pbes2Params
+		kdf    pbkdf2Params
+		iv     []byte
+	)
+	if _, err := asn1.Unmarshal(der, &ek); err != nil {
+		return nil, err
+	}
+	if !ek.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("encrypted key: unsupported scheme: %s", ek.Algo.Algorithm)
+	}
+	if _, err := asn1.Unmarshal(ek.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) || !params.Cipher.Algorithm.Equal(oidAES256CBC) {
+		return nil, fmt.Errorf("encrypted key: unsupported kdf or cipher: %s %s", params.KDF.Algorithm, params.Cipher.Algorithm)
+	}
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	if _, err := asn1.Unmarshal(params.Cipher.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil, kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("encrypted key: unsupported prf: %s", kdf.PRF.Algorithm)
+	}
+	block, err := aes.NewCipher(pbkdf2.Key(pass, kdf.Salt, kdf.Iterations, 32, prf))
+	if err != nil {
+		return nil, err
+	}
+	data := ek.Data
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 || len(iv) != aes.BlockSize {
+		return nil, ErrPassphrase
+	}
+	data = append([]byte(nil), data...)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, ErrPassphrase
+	}
+	for _, b := range data[len(data)-pad:] {
+		if int(b) != pad {
+			return nil, ErrPassphrase
+		}
+	}
+	return data[:len(data)-pad], nil
+}
+
+// passphrase returns the value of the environment variable
+// named by a -pass flag
+func passphrase(name string) ([]byte, error) {
+	pass, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("passphrase: $%s is not set", name)
+	}
+	return []byte(pass), nil
+}
+
+// marshalKey returns the pem block for the key: PKCS#8 if asked for
+// or if the key has no other encoding, and encrypted if pass is set
+func marshalKey(priv interface{}, pkcs8 bool, pass []byte) (*pem.Block, error) {
+	if !pkcs8 && pass == nil {
+		if b := pemBlockForKey(priv); b != nil {
+			return b, nil
+		}
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if pass != nil {
+		return encryptKey(der, pass)
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPValidity is how long a response may be cached
+const OCSPValidity = time.Hour
+
+// Responder answers OCSP requests for the certificates of one
+// issuer from its revocation database. It signs the responses
+// with the issuer's key. The database is read for every request,
+// so revocations take effect immediately. Mount it elsewhere than
+// the root with http.StripPrefix.
+type Responder struct {
+	Issuer *x509.Certificate
+	Key    crypto.Signer
+	DB     string
+}
+
+func (o *Responder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		der []byte
+		err error
+	)
+	switch r.Method {
+	case "GET":
+		var p string
+		if p, err = url.PathUnescape(r.URL.EscapedPath()); err == nil {
+			der, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(p, "/"))
+		}
+	case "POST":
+		der, err = ioutil.ReadAll(io.LimitReader(r.Body, 64*1024))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := o.respond(der, err)
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+	w.Write(resp)
+}
+
+func (o *Responder) respond(der []byte, err error) []byte {
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse
+	}
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse
+	}
+	if !o.issued(req) {
+		return ocsp.UnauthorizedErrorResponse
+	}
+	db, err := OpenDB(o.DB)
+	if err != nil {
+		log.Print(err)
+		return ocsp.InternalErrorErrorResponse
+	}
+	now := time.Now().Truncate(time.Minute)
+	tmpl := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(OCSPValidity),
+	}
+	if rec := db.Lookup(req.SerialNumber); rec != nil {
+		tmpl.Status = ocsp.Good
+		if rec.Status == 'R' {
+			tmpl.Status = ocsp.Revoked
+			tmpl.RevokedAt = rec.Revoked
+			tmpl.RevocationReason = rec.Reason
+		}
+	}
+	resp, err := ocsp.CreateResponse(o.Issuer, o.Issuer, tmpl, o.Key)
+	if err != nil {
+		log.Print(err)
+		return ocsp.InternalErrorErrorResponse
+	}
+	log.Printf("ocsp: serial %X: %s", req.SerialNumber, status(tmpl.Status))
+	return resp
+}
+
+// issued reports whether the request names this responder's issuer
+func (o *Responder) issued(req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+	h := req.HashAlgorithm.New()
+	h.Write(o.Issuer.RawSubject)
+	if !bytes.Equal(h.Sum(nil), req.IssuerNameHash) {
+		return false
+	}
+	spki, err := publicKeyBits(o.Issuer)
+	if err != nil {
+		return false
+	}
+	h = req.HashAlgorithm.New()
+	h.Write(spki)
+	return bytes.Equal(h.Sum(nil), req.IssuerKeyHash)
+}
+
+func status(s int) string {
+	switch s {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	}
+	return "unknown"
+}
+
+// serveStdio answers http requests read from standard input on
+// standard output until EOF, so the responder can run behind listen
+func serveStdio(h http.Handler) error {
+	in := bufio.NewReader(os.Stdin)
+	for {
+		req, err := http.ReadRequest(in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		w := &stdioWriter{header: http.Header{}, code: http.StatusOK}
+		h.ServeHTTP(w, req)
+		req.Body.Close()
+		resp := &http.Response{
+			StatusCode:    w.code,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        w.header,
+			Body:          ioutil.NopCloser(&w.body),
+			ContentLength: int64(w.body.Len()),
+			Request:       req,
+			Close:         req.Close,
+		}
+		if err := resp.Write(os.Stdout); err != nil || req.Close {
+			return err
+		}
+	}
+}
+
+type stdioWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *stdioWriter) Header() http.Header         { return w.header }
+func (w *stdioWriter) Write(p []byte) (int, error) { return w.body.Write(p) }
+func (w *stdioWriter) WriteHeader(code int)        { w.code = code }
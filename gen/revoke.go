@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// revoke marks the certificate named by -revoke revoked in the
+// issuer's database
+func revoke(db *DB) {
+	serial, err := parseSerial(*revokeSerial)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reason := 0
+	if *revokeReason != "" {
+		if reason, err = parseReason(*revokeReason); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := db.Revoke(serial, reason, time.Now()); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("revoked serial %X in %s\n", serial, db.File)
+}
+
+// writeCRL signs a revocation list of the database's revoked
+// certificates and writes it to -crl
+func writeCRL(db *DB, ca *Issuer) {
+	now := time.Now()
+	der, err := ca.Cert.CreateCRL(rand.Reader, ca.Key, db.Revoked(), now, now.Add(*crlFor))
+	if err != nil {
+		log.Fatalf("Failed to create crl: %s", err)
+	}
+	if err := writePEM(*crlPath, 0644, &pem.Block{Type: "X509 CRL", Bytes: der}); err != nil {
+		log.Fatalf("failed to write %s: %s", *crlPath, err)
+	}
+	log.Printf("created %s with %d revoked\n", *crlPath, len(db.Revoked()))
+}
+
+// serveOCSP runs the responder on -ocsp, an address or "-" for
+// standard input and output
+func serveOCSP(db *DB, ca *Issuer) {
+	h := &Responder{Issuer: ca.Cert, Key: ca.Key, DB: db.File}
+	if *ocspAddr == "-" {
+		// Listen may send stderr to the caller, so keep it quiet
+		log.SetOutput(ioutil.Discard)
+		if err := serveStdio(h); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	log.Printf("ocsp responder for %s on %s\n", ca.Cert.Subject, *ocspAddr)
+	log.Fatal(http.ListenAndServe(*ocspAddr, h))
+}
+
+// publicKeyBits returns the subject public key of c, which OCSP
+// hashes to identify the issuer
+func publicKeyBits(c *x509.Certificate) ([]byte, error) {
+	var spki struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(c.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	return spki.PublicKey.RightAlign(), nil
+}
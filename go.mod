@@ -24,5 +24,6 @@ require (
 	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
 	golang.org/x/mobile v0.0.0-20210716004757-34ab1303b554
 	golang.org/x/net v0.0.0-20210813160813-60bc85c4be6d
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 	rsc.io/pdf v0.1.1
 )
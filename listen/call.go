@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+)
+
+// Call is an answered connection. Closing a call cancels
+// its context, which kills any process created for it.
+type call struct {
+	net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (c *call) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if args.r && n > 0 {
+		record.Write(p[:n])
+	}
+	return n, err
+}
+
+func (c *call) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	if args.r && n > 0 {
+		record.Write(p[:n])
+	}
+	return n, err
+}
+
+func (c *call) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// record receives a copy of all traffic when -r is set
+var record = &lockedWriter{Writer: os.Stdout}
+
+// Line tracks active calls in the order they were answered
+// and enforces the limiters: -a, -e, and -k.
+type line struct {
+	sync.Mutex
+	cond   *sync.Cond
+	active []*call
+	ended  int
+
+	lim   int // maximum active calls
+	evict int // calls to end once lim is reached
+	kill  int // exit after this many calls end
+}
+
+func newline(lim, evict, kill int) *line {
+	l := &line{lim: lim, evict: evict, kill: kill}
+	l.cond = sync.NewCond(l)
+	return l
+}
+
+// Admit registers fd as an active call. If the line is full
+// it waits for a call to end, or evicts calls when -e is set.
+func (l *line) Admit(fd net.Conn) *call {
+	l.Lock()
+	defer l.Unlock()
+	for l.lim > 0 && len(l.active) >= l.lim {
+		if l.evict == 0 {
+			l.cond.Wait()
+			continue
+		}
+		l.end(l.evict)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &call{Conn: fd, ctx: ctx, cancel: cancel}
+	l.active = append(l.active, c)
+	return c
+}
+
+// end forcefully ends n calls: the oldest n calls if n > 0, or
+// the |n| most-recent calls if n < 0. The caller holds the lock.
+func (l *line) end(n int) {
+	var victims []*call
+	switch {
+	case n > 0:
+		if n > len(l.active) {
+			n = len(l.active)
+		}
+		victims = l.active[:n]
+		l.active = append([]*call{}, l.active[n:]...)
+	case n < 0:
+		n = -n
+		if n > len(l.active) {
+			n = len(l.active)
+		}
+		victims = l.active[len(l.active)-n:]
+		l.active = append([]*call{}, l.active[:len(l.active)-n]...)
+	}
+	for _, c := range victims {
+		verb("evict:", c.RemoteAddr())
+		c.Close()
+	}
+}
+
+// Hangup closes the call and removes it from the line. Listen
+// exits after the k'th hangup when -k is set.
+func (l *line) Hangup(c *call) {
+	c.Close()
+	l.Lock()
+	defer l.Unlock()
+	for i := range l.active {
+		if l.active[i] == c {
+			l.active = append(l.active[:i], l.active[i+1:]...)
+			break
+		}
+	}
+	l.ended++
+	verb("hangup:", c.RemoteAddr(), l.ended)
+	l.cond.Signal()
+	if l.kill > 0 && l.ended >= l.kill {
+		verb("kill:", l.ended, "calls ended")
+		os.Exit(0)
+	}
+}
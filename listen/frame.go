@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// Framed mode (-f) multiplexes stdin, stdout, stderr and the
+// exit status of cmd over one connection. A frame is a one byte
+// channel, a four byte big-endian payload length, and the payload.
+// An empty frame closes the channel. The exit frame carries the
+// decimal exit status of cmd and is the last frame sent.
+const (
+	chStdin  = 0
+	chStdout = 1
+	chStderr = 2
+	chExit   = 3
+)
+
+// MaxFrame is the largest payload accepted from the peer.
+// Larger writes are split into several frames.
+const MaxFrame = 1 << 20
+
+var errFrameSize = fmt.Errorf("frame: payload exceeds %d bytes", MaxFrame)
+
+// framer serializes frames written to w
+type framer struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (f *framer) Frame(ch byte, p []byte) error {
+	f.Lock()
+	defer f.Unlock()
+	var hdr [5]byte
+	hdr[0] = ch
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(p)))
+	if _, err := f.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := f.w.Write(p)
+	return err
+}
+
+// chanWriter writes each buffer as a frame on one channel
+type chanWriter struct {
+	f  *framer
+	ch byte
+}
+
+func (c *chanWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		m := len(p)
+		if m > MaxFrame {
+			m = MaxFrame
+		}
+		if err = c.f.Frame(c.ch, p[:m]); err != nil {
+			return n, err
+		}
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (c *chanWriter) Close() error {
+	return c.f.Frame(c.ch, nil)
+}
+
+func readframe(r io.Reader) (ch byte, p []byte, err error) {
+	var hdr [5]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > MaxFrame {
+		return 0, nil, errFrameSize
+	}
+	p = make([]byte, n)
+	if _, err = io.ReadFull(r, p); err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return hdr[0], p, nil
+}
+
+// run3f is run3 for framed mode. Stdout and stderr are sent on
+// separate channels followed by the exit status of cmd.
+func run3f(ctx context.Context, env []string, rw io.ReadWriter, cmd string, args ...string) (err error) {
+	defer verb("cmd: released")
+	f := &framer{w: rw}
+
+	c := exec.CommandContext(ctx, cmd, args...)
+	c.Env = append(os.Environ(), env...)
+	in, err := c.StdinPipe()
+	if err != nil {
+		return err
+	}
+	c.Stdout = &chanWriter{f, chStdout}
+	c.Stderr = &chanWriter{f, chStderr}
+
+	verb("cmd: born")
+	if err = c.Start(); err != nil {
+		f.Frame(chStderr, []byte(err.Error()+"\n"))
+		f.Frame(chExit, []byte("127"))
+		return err
+	}
+
+	go func() {
+		verb("open: net|cmd")
+		defer verb("close: net|cmd")
+		defer in.Close()
+		for {
+			ch, p, err := readframe(rw)
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					printerr("net|cmd", err)
+				}
+				return
+			}
+			if ch != chStdin {
+				continue
+			}
+			if len(p) == 0 {
+				return
+			}
+			if _, err := in.Write(p); err != nil {
+				printerr("net|cmd", err)
+				return
+			}
+		}
+	}()
+
+	err = c.Wait()
+	verb("cmd: moribound")
+	if ferr := f.Frame(chExit, []byte(strconv.Itoa(exitcode(err)))); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// exitcode returns the exit status of a process that ended with err
+func exitcode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() >= 0 {
+		return ee.ExitCode()
+	}
+	return 1
+}
+
+// errFramed is returned when -f is combined with a shared mode
+var errFramed = fmt.Errorf("-f requires cmd and can't be used with -s, -m or -d")
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	f := &framer{w: &buf}
+	want := []struct {
+		ch byte
+		p  string
+	}{
+		{chStdout, "hello"},
+		{chStderr, "world\n"},
+		{chStdout, ""},
+		{chExit, "0"},
+	}
+	for _, v := range want {
+		if err := f.Frame(v.ch, []byte(v.p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range want {
+		ch, p, err := readframe(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch != v.ch || string(p) != v.p {
+			t.Logf("have %d %q, want %d %q", ch, p, v.ch, v.p)
+			t.Fail()
+		}
+	}
+	if _, _, err := readframe(&buf); err != io.EOF {
+		t.Logf("have %v, want EOF", err)
+		t.Fail()
+	}
+}
+
+func TestFrameSplit(t *testing.T) {
+	var buf bytes.Buffer
+	w := &chanWriter{&framer{w: &buf}, chStdout}
+	data := bytes.Repeat([]byte("x"), 2*MaxFrame+1)
+	if n, err := w.Write(data); n != len(data) || err != nil {
+		t.Fatalf("write: %d %v", n, err)
+	}
+	var have []byte
+	for _, want := range []int{MaxFrame, MaxFrame, 1} {
+		ch, p, err := readframe(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch != chStdout || len(p) != want {
+			t.Logf("have %d bytes on %d, want %d bytes", len(p), ch, want)
+			t.Fail()
+		}
+		have = append(have, p...)
+	}
+	if !bytes.Equal(have, data) {
+		t.Log("split frames don't reassemble the write")
+		t.Fail()
+	}
+}
+
+func TestFrameBad(t *testing.T) {
+	var hdr [5]byte
+	hdr[0] = chStdin
+	binary.BigEndian.PutUint32(hdr[1:], MaxFrame+1)
+	if _, _, err := readframe(bytes.NewReader(hdr[:])); err != errFrameSize {
+		t.Logf("oversized: have %v, want %v", err, errFrameSize)
+		t.Fail()
+	}
+	binary.BigEndian.PutUint32(hdr[1:], 10)
+	short := append(hdr[:], "short"...)
+	if _, _, err := readframe(bytes.NewReader(short)); err != io.ErrUnexpectedEOF {
+		t.Logf("truncated: have %v, want %v", err, io.ErrUnexpectedEOF)
+		t.Fail()
+	}
+	if _, _, err := readframe(bytes.NewReader(hdr[:3])); err != io.ErrUnexpectedEOF {
+		t.Logf("short header: have %v, want %v", err, io.ErrUnexpectedEOF)
+		t.Fail()
+	}
+}
+
+func TestRun3f(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	done := make(chan error, 1)
+	go func() {
+		defer c1.Close()
+		done <- run3f(context.Background(), nil, c1, "sh", "-c", "cat; echo oops >&2; exit 3")
+	}()
+	f := &framer{w: c0}
+	go func() {
+		f.Frame(chStdin, []byte("ping\n"))
+		f.Frame(chStdin, nil)
+	}()
+	var stdout, stderr bytes.Buffer
+	for {
+		ch, p, err := readframe(c0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch == chExit {
+			if string(p) != "3" {
+				t.Logf("exit: have %q, want \"3\"", p)
+				t.Fail()
+			}
+			break
+		}
+		switch ch {
+		case chStdout:
+			stdout.Write(p)
+		case chStderr:
+			stderr.Write(p)
+		}
+	}
+	if stdout.String() != "ping\n" || stderr.String() != "oops\n" {
+		t.Logf("have stdout %q stderr %q", stdout.String(), stderr.String())
+		t.Fail()
+	}
+	if err := <-done; exitcode(err) != 3 {
+		t.Logf("run3f: have %v, want exit status 3", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ring holds the most recent bytes written to it. A
+// ring with zero capacity discards everything.
+type ring struct {
+	buf  []byte
+	off  int
+	full bool
+}
+
+func newring(size int) *ring {
+	return &ring{buf: make([]byte, size)}
+}
+
+func (r *ring) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(r.buf) == 0 {
+		return n, nil
+	}
+	if len(p) >= len(r.buf) {
+		copy(r.buf, p[len(p)-len(r.buf):])
+		r.off, r.full = 0, true
+		return n, nil
+	}
+	m := copy(r.buf[r.off:], p)
+	if m < len(p) {
+		copy(r.buf, p[m:])
+		r.full = true
+	}
+	r.off = (r.off + len(p)) % len(r.buf)
+	if r.off == 0 {
+		r.full = true
+	}
+	return n, nil
+}
+
+// Bytes returns the contents of the ring from oldest to newest
+func (r *ring) Bytes() []byte {
+	if !r.full {
+		return append([]byte{}, r.buf[:r.off]...)
+	}
+	return append(append([]byte{}, r.buf[r.off:]...), r.buf[:r.off]...)
+}
+
+// Hub broadcasts writes to every attached writer. Each writer
+// is fed from its own queue by its own goroutine, so a slow
+// caller doesn't hold up the others. Writers that fail, or whose
+// queue stays full for hubStall, are detached. A late joiner is
+// first sent the contents of the hub's ring buffer.
+type hub struct {
+	sync.Mutex
+	w    []*sink
+	ring *ring
+}
+
+// hubQueue is the number of writes queued for a writer
+const hubQueue = 64
+
+// hubStall is how long a write waits on a full queue
+var hubStall = 10 * time.Second
+
+type sink struct {
+	io.Writer
+	q    chan []byte
+	done chan struct{} // closed when detached
+	idle chan struct{} // closed when the queue is drained
+}
+
+func newhub(size int) *hub {
+	return &hub{ring: newring(size)}
+}
+
+func (h *hub) Write(p []byte) (int, error) {
+	h.Lock()
+	h.ring.Write(p)
+	w := append([]*sink{}, h.w...)
+	h.Unlock()
+	for _, s := range w {
+		b := append([]byte{}, p...)
+		select {
+		case s.q <- b:
+			continue
+		case <-s.done:
+			continue
+		default:
+		}
+		select {
+		case s.q <- b:
+		case <-s.done:
+		case <-time.After(hubStall):
+			verb("hub: detach: writer stalled")
+			h.remove(s)
+		}
+	}
+	return len(p), nil
+}
+
+// Attach adds w to the hub after queueing the ring for it
+func (h *hub) Attach(w io.Writer) {
+	s := &sink{
+		Writer: w,
+		q:      make(chan []byte, hubQueue),
+		done:   make(chan struct{}),
+		idle:   make(chan struct{}),
+	}
+	h.Lock()
+	if b := h.ring.Bytes(); len(b) > 0 {
+		s.q <- b
+	}
+	h.w = append(h.w, s)
+	h.Unlock()
+	go h.drain(s)
+}
+
+// drain writes s's queue to s. Once s is detached, it
+// writes what's left in the queue and returns.
+func (h *hub) drain(s *sink) {
+	defer close(s.idle)
+	write := func(p []byte) bool {
+		if _, err := s.Write(p); err != nil {
+			verb("hub: detach:", err)
+			h.remove(s)
+			return false
+		}
+		return true
+	}
+	for {
+		select {
+		case p := <-s.q:
+			if !write(p) {
+				return
+			}
+		case <-s.done:
+			for {
+				select {
+				case p := <-s.q:
+					if !write(p) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Detach removes w from the hub. It waits up to hubStall for
+// the writes already queued for w.
+func (h *hub) Detach(w io.Writer) {
+	h.Lock()
+	var s *sink
+	for _, v := range h.w {
+		if v.Writer == w {
+			s = v
+		}
+	}
+	h.Unlock()
+	if s == nil {
+		return
+	}
+	h.remove(s)
+	select {
+	case <-s.idle:
+	case <-time.After(hubStall):
+	}
+}
+
+// remove detaches s without waiting for its queue
+func (h *hub) remove(s *sink) {
+	h.Lock()
+	defer h.Unlock()
+	for i := range h.w {
+		if h.w[i] == s {
+			h.w = append(h.w[:i], h.w[i+1:]...)
+			close(s.done)
+			return
+		}
+	}
+}
+
+// lockedWriter serializes writes from concurrent callers
+type lockedWriter struct {
+	sync.Mutex
+	io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.Writer.Write(p)
+}
+
+// bufflag is a boolean flag with an optional ring
+// buffer size. Both -m and -m=4096 enable the option.
+type bufflag struct {
+	on   bool
+	size int
+}
+
+func (b *bufflag) IsBoolFlag() bool { return true }
+
+func (b *bufflag) String() string {
+	if b == nil || !b.on {
+		return "false"
+	}
+	return strconv.Itoa(b.size)
+}
+
+func (b *bufflag) Set(s string) error {
+	switch s {
+	case "true":
+		b.on = true
+		return nil
+	case "false":
+		b.on = false
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("bad buffer size: %q", s)
+	}
+	b.on, b.size = true, n
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// stall is a writer that blocks until released
+type stall chan struct{}
+
+func (s stall) Write(p []byte) (int, error) {
+	<-s
+	return len(p), nil
+}
+
+func TestHubStalled(t *testing.T) {
+	defer func(d time.Duration) { hubStall = d }(hubStall)
+	hubStall = 50 * time.Millisecond
+	h := newhub(0)
+	s := make(stall)
+	defer close(s)
+	h.Attach(s)
+	pr, pw := io.Pipe()
+	h.Attach(pw)
+	done := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(pr)
+		done <- b
+	}()
+
+	const n = 4 * hubQueue
+	wrote := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			h.Write([]byte("x"))
+		}
+		h.Detach(pw)
+		pw.Close()
+		close(wrote)
+	}()
+	select {
+	case <-wrote:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked on a stalled writer")
+	}
+	h.Lock()
+	attached := len(h.w)
+	h.Unlock()
+	if attached != 0 {
+		t.Logf("have %d writers attached, want the stalled one detached", attached)
+		t.Fail()
+	}
+	if b := <-done; len(b) != n {
+		t.Logf("have %d bytes, want %d", len(b), n)
+		t.Fail()
+	}
+}
+
+func TestHubReplay(t *testing.T) {
+	h := newhub(4)
+	h.Write([]byte("abcdef"))
+	pr, pw := io.Pipe()
+	h.Attach(pw)
+	h.Write([]byte("gh"))
+	b := make([]byte, 6)
+	if _, err := io.ReadFull(pr, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "cdefgh" {
+		t.Logf("have %q, want %q", b, "cdefgh")
+		t.Fail()
+	}
+	h.Detach(pw)
+}
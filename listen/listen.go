@@ -5,13 +5,15 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
+	"time"
 )
 import (
 	"github.com/as/mute"
@@ -24,10 +26,13 @@ const (
 
 var args struct {
 	h, q, v bool
-	k       bool
-	m       bool
+	s, r, f bool
+	m, d    bufflag
 	a       int
+	e       int
+	k       int
 	n       string
+	tls, ca string
 }
 
 var f *flag.FlagSet
@@ -37,11 +42,20 @@ func init() {
 	f.BoolVar(&args.h, "h", false, "")
 	f.BoolVar(&args.q, "?", false, "")
 	f.BoolVar(&args.v, "v", false, "")
-	f.BoolVar(&args.k, "k", false, "")
-	f.BoolVar(&args.m, "m", false, "")
+	f.BoolVar(&args.s, "s", false, "")
+	f.BoolVar(&args.r, "r", false, "")
+	f.BoolVar(&args.f, "f", false, "")
+	f.Var(&args.m, "m", "")
+	f.Var(&args.d, "d", "")
 	f.IntVar(&args.a, "a", 4096, "")
+	f.IntVar(&args.e, "e", 0, "")
+	f.IntVar(&args.k, "k", 0, "")
 	f.StringVar(&args.n, "n", "tcp4", "")
+	f.StringVar(&args.tls, "tls", "", "")
+	f.StringVar(&args.ca, "ca", "", "")
+}
 
+func argparse() {
 	err := mute.Parse(f, os.Args[1:])
 	if err != nil {
 		printerr(err)
@@ -50,6 +64,7 @@ func init() {
 }
 
 func main() {
+	argparse()
 	nargs := len(f.Args())
 	if args.h || args.q || nargs == 0 {
 		usage()
@@ -61,78 +76,138 @@ func main() {
 
 	ln, err := listener(args.n, srv)
 	sysfatal(err)
+	if args.tls != "" {
+		conf, err := tlsconfig(args.tls, args.ca)
+		sysfatal(err)
+		ln = tls.NewListener(ln, conf)
+	}
+
+	if args.f && (args.s || args.m.on || args.d.on || len(cmd) == 0) {
+		sysfatal(errFramed)
+	}
 
 	verb("announce:", ln.Addr())
-	if args.m {
-		streammux(ln, cmd...)
+	l := newline(args.a, args.e, args.k)
+	if args.s || len(cmd) == 0 {
+		shared(l, ln, cmd...)
 	} else {
-		stream(ln, cmd...)
+		stream(l, ln, cmd...)
 	}
 }
 
-func stream(ln net.Listener, cmd ...string) {
-	sem := make(chan bool, args.a)
+// serve answers calls on ln until it fails, then exits with
+// status 1. Each admitted call is passed to fn and hung up when
+// fn returns. Temporary accept errors are retried with an
+// increasing delay.
+func serve(l *line, ln net.Listener, fn func(c *call) error) {
+	var delay time.Duration
 	for {
-		sem <- true
-		go func(cfd net.Conn, err error) {
-			defer func() { <-sem }()
-			defer cfd.Close()
-			if err != nil {
+		fd, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				sysfatal(err)
+			}
+			printerr(err)
+			if delay *= 2; delay == 0 {
+				delay = 5 * time.Millisecond
+			}
+			if delay > time.Second {
+				delay = time.Second
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		verb("accept:", fd.RemoteAddr().String())
+		c := l.Admit(fd)
+		go func() {
+			defer l.Hangup(c)
+			if err := handshake(c.Conn); err != nil {
 				printerr(err)
 				return
 			}
-			verb("accept:", cfd.RemoteAddr().String())
-			if len(cmd) == 0 {
-				err := term3(cfd)
-				printerr(err)
-			} else {
-				err := run3(cfd, cmd[0], cmd[1:]...)
+			if err := fn(c); err != nil {
 				printerr(err)
 			}
-		}(ln.Accept())
+		}()
 	}
 }
-func streammux(ln net.Listener, cmd ...string) {
-	sem := make(chan bool, args.a)
-	pimper := make(chan io.ReadWriter)
-	pimpedwr := make([]io.Writer, 0)
-	pimpedrr := make([]io.Reader, 0)
-	pimped := make(map[io.Reader]int)
-	go func() {
-		i := 0
-		for p := range pimper {
-			pimpedwr = append(pimpedwr, p)
-			pimpedrr = append(pimpedrr, p)
-			mr := io.MultiReader(pimpedrr...)
-			mw := io.MultiWriter(pimpedwr...)
-			mrw := bufio.NewReadWriter(bufio.NewReader(mr), bufio.NewWriter(mw))
-			i = len(pimpedwr) - 1
-			pimped[p] = i
-			pimper <- mrw
+
+// stream runs a new cmd process for every caller. With -m
+// each process writes to all callers, with -d each process
+// reads from all callers.
+func stream(l *line, ln net.Listener, cmd ...string) {
+	var mux, dmux *hub
+	if args.m.on {
+		mux = newhub(args.m.size)
+	}
+	if args.d.on {
+		dmux = newhub(args.d.size)
+	}
+	serve(l, ln, func(c *call) error {
+		if args.f {
+			return run3f(c.ctx, aux(c.Conn), c, cmd[0], cmd[1:]...)
 		}
-	}()
-	for {
-		sem <- true
-		go func(cfd net.Conn, err error) {
-			defer func() { <-sem }()
-			defer cfd.Close()
-			pimper <- cfd
-			lol := <-pimper
-			if err != nil {
-				printerr(err)
-				return
-			}
-			verb("accept:", cfd.RemoteAddr().String())
-			if len(cmd) == 0 {
-				verb("accept:", cfd.RemoteAddr().String())
-				err := term3(cfd)
-				printerr(err)
-			} else {
-				err := run3(lol, cmd[0], cmd[1:]...)
-				printerr(err)
+		var (
+			r io.Reader = c
+			w io.Writer = c
+		)
+		if mux != nil {
+			mux.Attach(c)
+			defer mux.Detach(c)
+			w = mux
+		}
+		if dmux != nil {
+			pr, pw := io.Pipe()
+			defer pr.Close()
+			go func() {
+				defer pw.Close()
+				dmux.Attach(pw)
+				defer dmux.Detach(pw)
+				io.Copy(dmux, c)
+			}()
+			r = pr
+		}
+		return run3(c.ctx, aux(c.Conn), r, w, cmd[0], cmd[1:]...)
+	})
+}
+
+// shared connects every caller to one process. Callers' input
+// is merged into its stdin and its output is sent to all callers.
+// An empty cmd attaches the callers to listen's own stdin and stdout.
+func shared(l *line, ln net.Listener, cmd ...string) {
+	mux := newhub(args.m.size)
+	var in io.Writer
+	if len(cmd) == 0 {
+		in = &lockedWriter{Writer: os.Stdout}
+		go func() {
+			verb("open: stdin|net")
+			defer verb("close: stdin|net")
+			if _, err := io.Copy(mux, os.Stdin); err != nil {
+				printerr("stdin|net", err)
 			}
-		}(ln.Accept())
+		}()
+	} else {
+		c := exec.Command(cmd[0], cmd[1:]...)
+		stdin, err := c.StdinPipe()
+		sysfatal(err)
+		c.Stdout, c.Stderr = mux, mux
+		verb("cmd: born")
+		sysfatal(c.Start())
+		go func() {
+			err := c.Wait()
+			verb("cmd: moribound")
+			sysfatal(err)
+			os.Exit(0)
+		}()
+		in = &lockedWriter{Writer: stdin}
 	}
+	serve(l, ln, func(c *call) error {
+		mux.Attach(c)
+		defer mux.Detach(c)
+		_, err := io.Copy(in, c)
+		return err
+	})
 }
 
 var (
@@ -161,41 +236,20 @@ func verb(i ...interface{}) {
 		printerr(i...)
 	}
 }
-func term3(rw net.Conn) (err error) {
-	fin := make(chan error)
-	defer close(fin)
-	defer verb("stdin: released")
-	go func() {
-		verb("open: net|stdout")
-		defer verb("close: net|stdout")
-		//defer pw.Close()
-		_, err := io.Copy(os.Stdout, rw)
-		fin <- err
-	}()
-
-	func() {
-		verb("open: stdin|net")
-		defer verb("close: stdin|net")
-		if _, err := io.Copy(rw, os.Stdin); err != nil {
-			printerr("stdin|net", err)
-		}
-	}()
-	return <-fin
-}
 
-func run3(rw io.ReadWriter, cmd string, args ...string) (err error) {
-	fin := make(chan error)
-	defer close(fin)
+// run3 runs cmd until it exits or ctx is done. Cmd reads from r
+// and its stdout and stderr are written to w. The variables in env
+// are added to listen's environment.
+func run3(ctx context.Context, env []string, r io.Reader, w io.Writer, cmd string, args ...string) (err error) {
 	defer verb("cmd: released")
 
-	c := exec.Command(cmd, args...)
+	c := exec.CommandContext(ctx, cmd, args...)
+	c.Env = append(os.Environ(), env...)
 	in, err := c.StdinPipe()
 	if err != nil {
 		return err
 	}
-	pr, pw := io.Pipe()
-	defer pw.Close()
-	c.Stdout, c.Stderr = pw, pw
+	c.Stdout, c.Stderr = w, w
 
 	verb("cmd: born")
 	if err = c.Start(); err != nil {
@@ -205,27 +259,15 @@ func run3(rw io.ReadWriter, cmd string, args ...string) (err error) {
 	go func() {
 		verb("open: net|cmd")
 		defer verb("close: net|cmd")
-		if _, err := io.Copy(in, rw); err != nil {
-			printerr(err)
-		}
-		pw.Close()
-		fin <- err
-	}()
-
-	func() {
-		verb("open: cmd|net")
-		defer verb("close: cmd|net")
-		if _, err := io.Copy(rw, pr); err != nil {
-			printerr("cmd|net", err)
+		if _, err := io.Copy(in, r); err != nil && ctx.Err() == nil {
+			printerr("net|cmd", err)
 		}
+		in.Close()
 	}()
 
-	if err := <-fin; err != nil {
-		printerr("net|cmd", err)
-	}
-	in.Close()
+	err = c.Wait()
 	verb("cmd: moribound")
-	return c.Wait()
+	return err
 }
 
 /*
@@ -313,7 +355,7 @@ func printdebug(v ...interface{}) {
 }
 
 func usage() {
-	fmt.Println(`
+	fmt.Print(`
 NAME
 	listen - listen on a network interface
 
@@ -333,6 +375,8 @@ DESCRIPTION
 	Listen shares file descriptors and environment variables with
 	each cmd and injects auxillary variables identifying the local line
 	and remote caller: lnet, lhost, lport, rnet, rhost, rport.
+	With -tls -ca, rcert holds the subject of the caller's verified
+	certificate.
 
 NETWORKS
 	The net, host, and port are specified with plan9
@@ -351,23 +395,45 @@ LIMITERS
 	while n < 0, ends the |n| most-recent calls. Set -k n to kill
 	listen after n callers hang up.
 
+TLS
+	Set -tls cert.pem,key.pem to accept calls over tls using the
+	certificate and key written by gen. Set -ca ca.pem to require
+	callers to present a certificate signed by ca.pem.
+
+FRAMING
+	Set -f on both listen and dial to send stdin, stdout, stderr
+	and the exit status of cmd as separate channels over the call.
+	The caller then reproduces cmd's streams and exit status. Framing
+	requires cmd and can't be combined with -s, -m or -d.
+
 BROADCASTS
 	Mux (-m) and dmux (-d) provide a broadcasting for callers and
-	processes. Both can utilize an optional ring buffer of n bytes.
-	The default is no buffer.
+	processes. Both can utilize an optional ring buffer of n bytes,
+	set with -m=n or -d=n. The default is no buffer. A caller joining
+	a mux receives the ring's contents before any new output, and a
+	process joining a dmux reads the ring's contents as input.
+	A caller or process that stops reading for 10 seconds is dropped
+	from the broadcast so the others can continue.
+
+	With -s, all callers write to the shared process and -m=n sets
+	the size of its output history.
 
 OPTIONS
 	-t      Maintain the current user's privledges
 	-v      Verbose output
 
 	-a lim  Limit number of active calls to lim
-	-e n    After lim, n > 0 ends last n calls, else oldest |n| calls
+	-e n    After lim, n > 0 ends oldest n calls, else last |n| calls
 	-k n    Kill listen after the n'th call ends
 
 	-s      Connect all callers to one shared cmd process
-	-m buf  Mux: cmds write to all callers
-	-d buf  Demux: cmds read from all callers
+	-m[=buf]  Mux: cmds write to all callers
+	-d[=buf]  Demux: cmds read from all callers
 	-r      Record traffic to stdout
+	-f      Frame stdout, stderr and exit status (see FRAMING)
+
+	-tls cert.pem,key.pem  Terminate tls with the certificate and key
+	-ca ca.pem             Require client certificates signed by ca.pem
 
 EXAMPLE
 	Listen on tcp port 80 and serve index.html
@@ -376,10 +442,18 @@ EXAMPLE
 	Forward connections on port 80 to google.com:80
 		listen :80 dial google.com:80
 
+	Serve a shell over tls to callers holding a certificate signed by ca.pem
+		listen -tls cert.pem,key.pem -ca ca.pem :801 sh
+
+	Run a build step for callers, keeping stderr and the exit status
+		listen -f :802 make
+		dial -f host:802 >build.log
+
 	
 BUGS
 	Redundant on Plan 9.
 
-	Stdout and stderr are fused together into a miserable gulash.
+	Without -f, stdout and stderr are fused together into a
+	miserable gulash.
 `)
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// tlsconfig loads the certificate and key named by pair, a
+// comma-separated list: cert.pem,key.pem. If ca is not empty
+// callers must present a certificate signed by it.
+func tlsconfig(pair, ca string) (*tls.Config, error) {
+	files := strings.Split(pair, ",")
+	if len(files) != 2 {
+		return nil, fmt.Errorf("tls: want cert.pem,key.pem: have %q", pair)
+	}
+	cert, err := tls.LoadX509KeyPair(files[0], files[1])
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if ca == "" {
+		return conf, nil
+	}
+	pem, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls: no certificates in %s", ca)
+	}
+	conf.ClientCAs = pool
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	return conf, nil
+}
+
+// HandshakeTimeout bounds how long a caller may take to
+// complete the tls handshake.
+const HandshakeTimeout = 10 * time.Second
+
+// handshake completes the tls handshake for tls connections
+// so that bad callers are rejected before cmd runs.
+func handshake(fd net.Conn) error {
+	t, ok := fd.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	t.SetDeadline(time.Now().Add(HandshakeTimeout))
+	if err := t.Handshake(); err != nil {
+		return err
+	}
+	t.SetDeadline(time.Time{})
+	if subj := subject(fd); subj != "" {
+		verb("tls: subject:", subj)
+	}
+	return nil
+}
+
+// subject returns the subject of the caller's verified
+// certificate, or an empty string.
+func subject(fd net.Conn) string {
+	t, ok := fd.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	st := t.ConnectionState()
+	if len(st.VerifiedChains) == 0 || len(st.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return st.VerifiedChains[0][0].Subject.String()
+}
+
+// aux returns the auxillary variables identifying the local
+// line and the remote caller.
+func aux(fd net.Conn) (env []string) {
+	for _, a := range []struct {
+		prefix string
+		addr   net.Addr
+	}{
+		{"l", fd.LocalAddr()},
+		{"r", fd.RemoteAddr()},
+	} {
+		host, port, _ := net.SplitHostPort(a.addr.String())
+		env = append(env,
+			a.prefix+"net="+a.addr.Network(),
+			a.prefix+"host="+host,
+			a.prefix+"port="+port,
+		)
+	}
+	if subj := subject(fd); subj != "" {
+		env = append(env, "rcert="+subj)
+	}
+	return env
+}
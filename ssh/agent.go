@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// keyring is the ssh-agent, or nil if none is running
+var keyring agent.ExtendedAgent
+
+// dialagent connects to the agent listening on $SSH_AUTH_SOCK
+func dialagent() agent.ExtendedAgent {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil
+	}
+	fd, err := net.Dial("unix", sock)
+	if err != nil {
+		log.Printf("agent: %s", err)
+		return nil
+	}
+	verb("agent:", sock)
+	return agent.NewClient(fd)
+}
+
+// forwardagent forwards the agent to the remote session (-A)
+func forwardagent(conn *ssh.Client, session *ssh.Session) error {
+	if keyring == nil {
+		log.Print("agent: no agent to forward: SSH_AUTH_SOCK is not set")
+		return nil
+	}
+	if err := agent.ForwardToAgent(conn, keyring); err != nil {
+		return err
+	}
+	return agent.RequestAgentForwarding(session)
+}
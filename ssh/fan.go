@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Result is the outcome of running cmd on one host
+type Result struct {
+	Host   string
+	Status int
+	Err    error
+}
+
+// hosts reads dial strings from r, one per line. Blank
+// lines and lines starting with # are ignored.
+func hosts(r io.Reader) (list []string, err error) {
+	in := bufio.NewScanner(r)
+	for in.Scan() {
+		h := strings.TrimSpace(in.Text())
+		if h == "" || h[0] == '#' {
+			continue
+		}
+		list = append(list, h)
+	}
+	return list, in.Err()
+}
+
+// Fan runs cmd on every host, at most n at a time. Each line of
+// output is prefixed with the host that wrote it.
+func Fan(config *ssh.ClientConfig, list []string, n int, cmd string) []Result {
+	if n < 1 {
+		n = 1
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		sem    = make(chan bool, n)
+		result = make([]Result, len(list))
+	)
+	for i, host := range list {
+		wg.Add(1)
+		sem <- true
+		go func(i int, host string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			stdout := &prefixWriter{mu: &mu, w: os.Stdout, prefix: host + "\t"}
+			stderr := &prefixWriter{mu: &mu, w: os.Stderr, prefix: host + "\t"}
+			status, err := run(config, host, cmd, stdout, stderr)
+			stdout.Flush()
+			stderr.Flush()
+			result[i] = Result{Host: host, Status: status, Err: err}
+			verb("fan:", host, status)
+		}(i, host)
+	}
+	wg.Wait()
+	return result
+}
+
+// run runs cmd on host and returns its exit status. Failures
+// that prevent cmd from running return 255 and an error.
+func run(config *ssh.ClientConfig, host, cmd string, stdout, stderr io.Writer) (int, error) {
+	a := dialsplit(host)
+	if a == nil {
+		return 255, fmt.Errorf("bad dial string: %q", host)
+	}
+	addr := a.addr + ":" + a.svc
+	conn, err := ssh.Dial(a.net, addr, hostconfig(config, addr))
+	if err != nil {
+		return 255, err
+	}
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		return 255, err
+	}
+	defer session.Close()
+	session.Stdout, session.Stderr = stdout, stderr
+	err = session.Run(cmd)
+	var ee *ssh.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &ee):
+		return ee.ExitStatus(), nil
+	}
+	return 255, err
+}
+
+// Report writes one tab-separated line per result: the host,
+// the exit status, and ok or the error.
+func Report(w io.Writer, result []Result) error {
+	for _, r := range result {
+		msg := "ok"
+		if r.Err != nil {
+			msg = strings.Replace(r.Err.Error(), "\t", " ", -1)
+		} else if r.Status != 0 {
+			msg = "exit"
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%d\t%s\n", r.Host, r.Status, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixWriter writes complete lines to w with a prefix. The
+// mutex is shared by all writers so that lines don't interleave.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	i := bytes.LastIndexByte(p.buf, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+	lines := p.buf[:i+1]
+	var out []byte
+	for len(lines) > 0 {
+		j := bytes.IndexByte(lines, '\n')
+		out = append(out, p.prefix...)
+		out = append(out, lines[:j+1]...)
+		lines = lines[j+1:]
+	}
+	p.buf = append(p.buf[:0], p.buf[i+1:]...)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(out)
+	return len(b), err
+}
+
+// Flush writes a trailing partial line
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	_, err := p.Write([]byte{'\n'})
+	return err
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forwards is a repeatable flag holding forwarding specs
+type forwards []string
+
+func (f *forwards) String() string { return strings.Join(*f, " ") }
+
+func (f *forwards) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// Forward is a parsed forwarding spec. Calls answered on
+// the listen endpoint are connected to the dial endpoint.
+type Forward struct {
+	listen, dial *Addr
+}
+
+// hostport returns the address in the form used by net.Dial.
+// A host of * or an empty host means all interfaces.
+func (a *Addr) hostport() string {
+	host := a.addr
+	if host == "*" {
+		host = ""
+	}
+	return net.JoinHostPort(host, a.svc)
+}
+
+// endpoint parses a dial string with a mandatory port. The
+// host defaults to def when only a port is given.
+func endpoint(dial, def string) (*Addr, error) {
+	delim := ":"
+	if strings.Contains(dial, "!") {
+		delim = "!"
+	}
+	a := &Addr{net: "tcp", addr: def}
+	switch s := strings.Split(dial, delim); len(s) {
+	case 1:
+		a.svc = s[0]
+	case 2:
+		a.addr, a.svc = s[0], s[1]
+	case 3:
+		a.net, a.addr, a.svc = s[0], s[1], s[2]
+	default:
+		return nil, fmt.Errorf("bad endpoint: %q", dial)
+	}
+	if a.svc == "" {
+		return nil, fmt.Errorf("bad endpoint: %q: need a port", dial)
+	}
+	return a, nil
+}
+
+// parseforward parses a spec in the OpenSSH form [bind:]port:host:hostport
+// or as two dial strings separated by a comma: net!host!port,net!host!port.
+func parseforward(spec string) (*Forward, error) {
+	var l, d string
+	if i := strings.Index(spec, ","); i >= 0 {
+		l, d = spec[:i], spec[i+1:]
+	} else {
+		s := strings.Split(spec, ":")
+		switch len(s) {
+		case 3:
+			l, d = s[0], s[1]+":"+s[2]
+		case 4:
+			l, d = s[0]+":"+s[1], s[2]+":"+s[3]
+		default:
+			return nil, fmt.Errorf("bad forward: %q", spec)
+		}
+	}
+	la, err := endpoint(l, "localhost")
+	if err != nil {
+		return nil, err
+	}
+	da, err := endpoint(d, "localhost")
+	if err != nil {
+		return nil, err
+	}
+	return &Forward{listen: la, dial: da}, nil
+}
+
+// Local listens on the local endpoint and dials the remote
+// endpoint through the ssh connection (-L).
+func Local(c *ssh.Client, fw *Forward) error {
+	ln, err := net.Listen(fw.listen.net, fw.listen.hostport())
+	if err != nil {
+		return err
+	}
+	verb("forward: local", ln.Addr(), "->", fw.dial.hostport())
+	go serveforward(ln, func() (net.Conn, error) {
+		return c.Dial(fw.dial.net, fw.dial.hostport())
+	})
+	return nil
+}
+
+// Remote asks the server to listen on the remote endpoint
+// and dials the local endpoint for each call (-R).
+func Remote(c *ssh.Client, fw *Forward) error {
+	ln, err := c.Listen(fw.listen.net, fw.listen.hostport())
+	if err != nil {
+		return err
+	}
+	verb("forward: remote", ln.Addr(), "->", fw.dial.hostport())
+	go serveforward(ln, func() (net.Conn, error) {
+		return net.Dial(fw.dial.net, fw.dial.hostport())
+	})
+	return nil
+}
+
+// Dynamic runs a SOCKS5 proxy on the local endpoint and
+// dials each requested destination through the ssh connection (-D).
+func Dynamic(c *ssh.Client, spec string) error {
+	a, err := endpoint(spec, "localhost")
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen(a.net, a.hostport())
+	if err != nil {
+		return err
+	}
+	verb("forward: socks", ln.Addr())
+	go func() {
+		for {
+			fd, err := ln.Accept()
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			go func() {
+				defer fd.Close()
+				dst, err := socks(fd, c)
+				if err != nil {
+					verb("socks:", err)
+					return
+				}
+				defer dst.Close()
+				splice(fd, dst)
+			}()
+		}
+	}()
+	return nil
+}
+
+func serveforward(ln net.Listener, dial func() (net.Conn, error)) {
+	for {
+		fd, err := ln.Accept()
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		go func() {
+			defer fd.Close()
+			dst, err := dial()
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			defer dst.Close()
+			splice(fd, dst)
+		}()
+	}
+}
+
+// splice copies between a and b until both sides hang up.
+// Each side's write half is closed when the other side is done.
+func splice(a, b io.ReadWriter) {
+	done := make(chan bool, 2)
+	cp := func(dst, src io.ReadWriter) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		done <- true
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	<-done
+}
+
+// SOCKS5 reply codes
+const (
+	socksOK          = 0x00
+	socksFail        = 0x01
+	socksRefused     = 0x05
+	socksBadCommand  = 0x07
+	socksBadAddrType = 0x08
+)
+
+// SOCKS5 authentication methods
+const (
+	socksNoAuth    = 0x00
+	socksNoMethods = 0xff // none of the offered methods is acceptable
+)
+
+// socks answers a SOCKS5 CONNECT request on fd without
+// authentication and returns the connection to the destination.
+// A client that doesn't offer to go without authentication is
+// refused.
+func socks(fd io.ReadWriter, c *ssh.Client) (net.Conn, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(fd, hdr[:2]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 5 {
+		return nil, fmt.Errorf("bad version: %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(fd, methods); err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(methods, socksNoAuth) < 0 {
+		fd.Write([]byte{5, socksNoMethods})
+		return nil, fmt.Errorf("no acceptable auth method in %v", methods)
+	}
+	if _, err := fd.Write([]byte{5, socksNoAuth}); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(fd, hdr[:]); err != nil {
+		return nil, err
+	}
+	reply := func(code byte) {
+		fd.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	}
+	if hdr[1] != 1 {
+		reply(socksBadCommand)
+		return nil, fmt.Errorf("unsupported command: %d", hdr[1])
+	}
+	var host string
+	switch hdr[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if hdr[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(fd, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(fd, n[:]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(fd, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		reply(socksBadAddrType)
+		return nil, fmt.Errorf("unsupported address type: %d", hdr[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(fd, port[:]); err != nil {
+		return nil, err
+	}
+	dst := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	verb("socks: connect", dst)
+	conn, err := c.Dial("tcp", dst)
+	if err != nil {
+		reply(socksRefused)
+		return nil, err
+	}
+	reply(socksOK)
+	return conn, nil
+}
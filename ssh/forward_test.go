@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// socksconn is a client's half of a socks conversation
+type socksconn struct {
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *socksconn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *socksconn) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+func TestSocksMethods(t *testing.T) {
+	for _, v := range []struct {
+		in   string
+		want string
+	}{
+		{"\x05\x01\x02", "\x05\xff"},
+		{"\x05\x02\x01\x02", "\x05\xff"},
+		{"\x05\x00", "\x05\xff"},
+		{"\x05\x02\x02\x00\x00\x02\x00\x00", "\x05\x00\x05\x07\x00\x01\x00\x00\x00\x00\x00\x00"},
+	} {
+		fd := &socksconn{in: strings.NewReader(v.in)}
+		if _, err := socks(fd, nil); err == nil {
+			t.Logf("%q: no error", v.in)
+			t.Fail()
+		}
+		if have := fd.out.String(); have != v.want {
+			t.Logf("%q: have reply %q, want %q", v.in, have, v.want)
+			t.Fail()
+		}
+	}
+}
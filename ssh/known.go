@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key trust modes
+const (
+	TrustStrict = "strict" // refuse hosts not in known_hosts
+	TrustTOFU   = "tofu"   // record unknown hosts on first use
+	TrustOff    = "off"    // accept any host key
+)
+
+// sshfile returns the path of the named file in ~/.ssh
+func sshfile(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(home, ".ssh", name)
+}
+
+// HostKeys returns a callback that verifies host keys against the
+// known_hosts file in the given trust mode. Unknown hosts are
+// refused in strict mode and appended to file in tofu mode. A
+// changed key is always refused. The callback is safe for
+// concurrent use, and rereads file after recording a host.
+func HostKeys(file, mode string) (ssh.HostKeyCallback, error) {
+	switch mode {
+	case TrustOff:
+		log.Print("warning: host key verification disabled")
+		return ssh.InsecureIgnoreHostKey(), nil
+	case TrustStrict, TrustTOFU:
+	default:
+		return nil, fmt.Errorf("bad trust mode: %q", mode)
+	}
+	if mode == TrustTOFU {
+		if err := touch(file); err != nil {
+			return nil, err
+		}
+	}
+	check, err := knownhosts.New(file)
+	if err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex
+	return func(host string, remote net.Addr, key ssh.PublicKey) error {
+		mu.Lock()
+		defer mu.Unlock()
+		err := check(host, remote, key)
+		var ke *knownhosts.KeyError
+		if err == nil || !errors.As(err, &ke) {
+			return err
+		}
+		if len(ke.Want) > 0 {
+			keychanged(host, file, ke.Want, key)
+			return fmt.Errorf("%s: host key has changed", host)
+		}
+		if mode == TrustStrict {
+			log.Printf("%s: unknown host key: %s %s", host, key.Type(), ssh.FingerprintSHA256(key))
+			return fmt.Errorf("%s: host not in %s", host, file)
+		}
+		log.Printf("%s: trusting new host key: %s %s", host, key.Type(), ssh.FingerprintSHA256(key))
+		if err := remember(file, host, key); err != nil {
+			return err
+		}
+		check, err = knownhosts.New(file)
+		return err
+	}, nil
+}
+
+// KnownAlgorithms returns the host key types recorded in file
+// for addr, so that a host with several keys is asked for one
+// that can be checked. It returns nil for an unknown host.
+func KnownAlgorithms(file, addr string) (algs []string) {
+	check, err := knownhosts.New(file)
+	if err != nil {
+		return nil
+	}
+	var ke *knownhosts.KeyError
+	err = check(addr, &net.TCPAddr{IP: net.IPv4zero}, probe{})
+	if !errors.As(err, &ke) {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, k := range ke.Want {
+		if t := k.Key.Type(); !seen[t] {
+			seen[t] = true
+			algs = append(algs, t)
+		}
+	}
+	return algs
+}
+
+// probe is a key that matches no known_hosts entry
+type probe struct{}
+
+func (probe) Type() string                        { return "probe" }
+func (probe) Marshal() []byte                     { return []byte("probe") }
+func (probe) Verify([]byte, *ssh.Signature) error { return errors.New("probe") }
+
+// keychanged prints the known and presented fingerprints
+func keychanged(host, file string, known []knownhosts.KnownKey, key ssh.PublicKey) {
+	log.Printf("WARNING: %s: host key has changed, possible man-in-the-middle", host)
+	for _, k := range known {
+		log.Printf("- %s %s (%s:%d)", k.Key.Type(), ssh.FingerprintSHA256(k.Key), k.Filename, k.Line)
+	}
+	log.Printf("+ %s %s", key.Type(), ssh.FingerprintSHA256(key))
+	log.Printf("remove the old key from %s if the change is expected", file)
+}
+
+// remember appends a hashed known_hosts entry for host
+func remember(file, host string, key ssh.PublicKey) error {
+	fd, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	line := knownhosts.Line([]string{knownhosts.HashHostname(knownhosts.Normalize(host))}, key)
+	if _, err = fmt.Fprintln(fd, line); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// touch creates file and its parent directory if they don't exist
+func touch(file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return fd.Close()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var remote = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+
+func ed25519key(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func ecdsakey(t *testing.T) ssh.PublicKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// tempknown returns the path of a known_hosts file in a new
+// directory, and a function that removes the directory
+func tempknown(t *testing.T) (file string, done func()) {
+	dir, err := ioutil.TempDir("", "known")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.SetOutput(ioutil.Discard)
+	return filepath.Join(dir, ".ssh", "known_hosts"), func() {
+		log.SetOutput(os.Stderr)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestTOFU(t *testing.T) {
+	file, done := tempknown(t)
+	defer done()
+	key, other := ed25519key(t), ed25519key(t)
+
+	check, err := HostKeys(file, TrustTOFU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := check("host.example:22", remote, key); err != nil {
+		t.Fatalf("first use: %s", err)
+	}
+	data, _ := ioutil.ReadFile(file)
+	if strings.Contains(string(data), "host.example") || !strings.HasPrefix(string(data), "|1|") {
+		t.Logf("entry isn't hashed: %q", data)
+		t.Fail()
+	}
+
+	// the same callback knows the host it just recorded
+	if err := check("host.example:22", remote, key); err != nil {
+		t.Fatalf("second call: %s", err)
+	}
+	if err := check("host.example:22", remote, other); err == nil {
+		t.Log("second call: changed key accepted")
+		t.Fail()
+	}
+	if data2, _ := ioutil.ReadFile(file); string(data2) != string(data) {
+		t.Logf("second call: have %q, want %q", data2, data)
+		t.Fail()
+	}
+
+	// a new callback rereads the file
+	check, err = HostKeys(file, TrustTOFU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := check("host.example:22", remote, key); err != nil {
+		t.Logf("second use: %s", err)
+		t.Fail()
+	}
+	if err := check("host.example:22", remote, other); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Logf("changed key: have %v, want a changed key error", err)
+		t.Fail()
+	}
+	data2, _ := ioutil.ReadFile(file)
+	if string(data2) != string(data) {
+		t.Log("changed key was recorded")
+		t.Fail()
+	}
+}
+
+func TestStrict(t *testing.T) {
+	file, done := tempknown(t)
+	defer done()
+	key, other := ed25519key(t), ed25519key(t)
+
+	if _, err := HostKeys(file, TrustStrict); err == nil {
+		t.Log("strict: missing known_hosts accepted")
+		t.Fail()
+	}
+	os.MkdirAll(filepath.Dir(file), 0700)
+	line := knownhosts.Line([]string{knownhosts.Normalize("host.example:22")}, key)
+	if err := ioutil.WriteFile(file, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	check, err := HostKeys(file, TrustStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		host string
+		key  ssh.PublicKey
+		ok   bool
+	}{
+		{"host.example:22", key, true},
+		{"host.example:22", other, false},
+		{"new.example:22", key, false},
+	} {
+		if err := check(v.host, remote, v.key); (err == nil) != v.ok {
+			t.Logf("%s: have %v, want ok=%v", v.host, err, v.ok)
+			t.Fail()
+		}
+	}
+	data, _ := ioutil.ReadFile(file)
+	if string(data) != line+"\n" {
+		t.Logf("strict mode wrote to known_hosts: %q", data)
+		t.Fail()
+	}
+}
+
+func TestTrustMode(t *testing.T) {
+	file, done := tempknown(t)
+	defer done()
+	check, err := HostKeys(file, TrustOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := check("host.example:22", remote, ed25519key(t)); err != nil {
+		t.Logf("off: %s", err)
+		t.Fail()
+	}
+	if _, err := HostKeys(file, "maybe"); err == nil {
+		t.Log("bad trust mode accepted")
+		t.Fail()
+	}
+}
+
+func TestKnownAlgorithms(t *testing.T) {
+	file, done := tempknown(t)
+	defer done()
+	check, err := HostKeys(file, TrustTOFU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k1, k2 := ed25519key(t), ecdsakey(t)
+	remember(file, "two.example:22", k1)
+	remember(file, "two.example:22", k2)
+	remember(file, "one.example:2222", k1)
+
+	for _, v := range []struct {
+		addr string
+		want []string
+	}{
+		{"two.example:22", []string{k1.Type(), k2.Type()}},
+		{"one.example:2222", []string{k1.Type()}},
+		{"one.example:22", nil},
+		{"new.example:22", nil},
+	} {
+		// the order of the entries is not significant
+		have := KnownAlgorithms(file, v.addr)
+		sort.Strings(have)
+		sort.Strings(v.want)
+		if !reflect.DeepEqual(have, v.want) {
+			t.Logf("%s: have %q, want %q", v.addr, have, v.want)
+			t.Fail()
+		}
+	}
+	if err := check("two.example:22", remote, k2); err != nil {
+		t.Logf("second key: %s", err)
+		t.Fail()
+	}
+	if have := KnownAlgorithms(filepath.Join(file, "nosuch"), "two.example:22"); have != nil {
+		t.Logf("missing file: have %q", have)
+		t.Fail()
+	}
+}
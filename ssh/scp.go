@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scp speaks the scp protocol with a remote scp process
+type scp struct {
+	s *ssh.Session
+	w io.WriteCloser
+	r *bufio.Reader
+}
+
+// scpWarning is a per-file error reported by the remote scp.
+// The transfer continues after a warning.
+type scpWarning string
+
+func (e scpWarning) Error() string { return string(e) }
+
+// quote quotes s for the remote shell
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func startscp(c *ssh.Client, args string) (*scp, error) {
+	s, err := c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.StdinPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	r, err := s.StdoutPipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.Stderr = os.Stderr
+	verb("scp:", args)
+	if err := s.Start("scp " + args); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &scp{s: s, w: w, r: bufio.NewReader(r)}, nil
+}
+
+// ack reads the remote's response to the last record
+func (p *scp) ack() error {
+	b, err := p.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := p.r.ReadString('\n')
+	msg = strings.TrimSpace(msg)
+	if b == 1 {
+		return scpWarning(msg)
+	}
+	return fmt.Errorf("scp: %s", msg)
+}
+
+func (p *scp) record(format string, v ...interface{}) error {
+	if _, err := fmt.Fprintf(p.w, format, v...); err != nil {
+		return err
+	}
+	return p.ack()
+}
+
+// open opens a local regular file for sending
+func open(file string) (*os.File, os.FileInfo, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := fd.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = fmt.Errorf("%s: not a regular file", file)
+	}
+	if err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+	return fd, fi, nil
+}
+
+// send sends fd as name with its mode and modification time
+func (p *scp) send(name string, fd *os.File, fi os.FileInfo) error {
+	mtime := fi.ModTime().Unix()
+	if err := p.record("T%d 0 %d 0\n", mtime, mtime); err != nil {
+		return err
+	}
+	if err := p.record("C%04o %d %s\n", fi.Mode().Perm(), fi.Size(), name); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(p.w, fd, fi.Size()); err != nil {
+		return err
+	}
+	if _, err := p.w.Write([]byte{0}); err != nil {
+		return err
+	}
+	return p.ack()
+}
+
+func (p *scp) close() error {
+	p.w.Close()
+	return p.s.Wait()
+}
+
+// Put copies the local file to remote
+func Put(c *ssh.Client, local, remote string) error {
+	fd, fi, err := open(local)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	p, err := startscp(c, "-p -t "+quote(remote))
+	if err != nil {
+		return err
+	}
+	if err = p.ack(); err == nil {
+		err = p.send(filepath.Base(local), fd, fi)
+	}
+	if cerr := p.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// PutList copies each file named in the walk output read from r
+// to the remote directory dir, preserving the relative path. It
+// returns the number of files that failed.
+func PutList(c *ssh.Client, r io.Reader, dir string) (failed int, err error) {
+	p, err := startscp(c, "-r -d -p -t "+quote(dir))
+	if err != nil {
+		return 0, err
+	}
+	if err := p.ack(); err != nil {
+		p.close()
+		return 0, err
+	}
+	var cwd []string // remote directories entered below dir
+	in := bufio.NewScanner(r)
+	for in.Scan() {
+		file := in.Text()
+		rel, ok := relative(file)
+		if !ok {
+			log.Printf("put: ignored: %s", file)
+			failed++
+			continue
+		}
+		fd, fi, ferr := open(file)
+		if ferr != nil {
+			log.Printf("put: %s", ferr)
+			failed++
+			continue
+		}
+		elem := strings.Split(rel, "/")
+		dirs, name := elem[:len(elem)-1], elem[len(elem)-1]
+		n := 0
+		for n < len(cwd) && n < len(dirs) && cwd[n] == dirs[n] {
+			n++
+		}
+		for ; len(cwd) > n; cwd = cwd[:len(cwd)-1] {
+			if err = p.record("E\n"); err != nil {
+				break
+			}
+		}
+		for _, d := range dirs[n:] {
+			if err = p.record("D0755 0 %s\n", d); err != nil {
+				break
+			}
+			cwd = append(cwd, d)
+		}
+		if err == nil {
+			err = p.send(name, fd, fi)
+		}
+		fd.Close()
+		if _, ok := err.(scpWarning); ok {
+			log.Printf("put: %s: %s", file, err)
+			failed++
+			err = nil
+			continue
+		}
+		if err != nil {
+			break
+		}
+		verb("put:", file)
+	}
+	if err == nil {
+		err = in.Err()
+	}
+	if cerr := p.close(); err == nil {
+		err = cerr
+	}
+	return failed, err
+}
+
+// relative returns file as a clean slash-separated relative path
+func relative(file string) (string, bool) {
+	file = path.Clean(filepath.ToSlash(file))
+	if file == "." || path.IsAbs(file) || file == ".." || strings.HasPrefix(file, "../") {
+		return "", false
+	}
+	return file, true
+}
+
+// Get copies the remote file to local. If local is a
+// directory, the file is created inside it.
+func Get(c *ssh.Client, remote, local string) error {
+	p, err := startscp(c, "-p -f "+quote(remote))
+	if err != nil {
+		return err
+	}
+	err = p.sink(local)
+	if cerr := p.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// GetList copies each remote file named in the list read from r
+// into the local directory dir, preserving the relative path. It
+// returns the number of files that failed.
+func GetList(c *ssh.Client, r io.Reader, dir string) (failed int, err error) {
+	in := bufio.NewScanner(r)
+	for in.Scan() {
+		file := in.Text()
+		rel, ok := relative(file)
+		if !ok {
+			log.Printf("get: ignored: %s", file)
+			failed++
+			continue
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			log.Printf("get: %s: %s", file, err)
+			failed++
+			continue
+		}
+		if err := Get(c, file, dst); err != nil {
+			log.Printf("get: %s: %s", file, err)
+			failed++
+			continue
+		}
+		verb("get:", file)
+	}
+	return failed, in.Err()
+}
+
+// sink receives files from a remote scp source and writes them
+// to target, restoring their mode and modification time.
+func (p *scp) sink(target string) error {
+	var (
+		mtime time.Time
+		warn  error
+	)
+	if _, err := p.w.Write([]byte{0}); err != nil {
+		return err
+	}
+	for {
+		line, err := p.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return warn
+		}
+		if err != nil {
+			return err
+		}
+		switch line[0] {
+		case 1:
+			warn = scpWarning(strings.TrimSpace(line[1:]))
+			continue
+		case 2:
+			return fmt.Errorf("scp: %s", strings.TrimSpace(line[1:]))
+		case 'T':
+			var sec, atime int64
+			if _, err := fmt.Sscanf(line, "T%d 0 %d 0", &sec, &atime); err != nil {
+				return fmt.Errorf("scp: bad record: %q", line)
+			}
+			mtime = time.Unix(sec, 0)
+		case 'C':
+			if err := p.file(target, line, mtime); err != nil {
+				return err
+			}
+			mtime = time.Time{}
+			continue
+		default:
+			return fmt.Errorf("scp: unexpected record: %q", line)
+		}
+		if _, err := p.w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+}
+
+// file receives the file described by the C record in line
+func (p *scp) file(target, line string, mtime time.Time) error {
+	f := strings.SplitN(strings.TrimSpace(line[1:]), " ", 3)
+	if len(f) != 3 {
+		return fmt.Errorf("scp: bad record: %q", line)
+	}
+	mode, err1 := strconv.ParseUint(f[0], 8, 32)
+	size, err2 := strconv.ParseInt(f[1], 10, 64)
+	name := f[2]
+	if err1 != nil || err2 != nil || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("scp: bad record: %q", line)
+	}
+	if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+		target = filepath.Join(target, name)
+	}
+	if _, err := p.w.Write([]byte{0}); err != nil {
+		return err
+	}
+
+	var dst io.Writer = ioutil.Discard
+	fd, ferr := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(mode))
+	if ferr == nil {
+		dst = fd
+	}
+	_, err := io.CopyN(dst, p.r, size)
+	if fd != nil {
+		if cerr := fd.Close(); ferr == nil {
+			ferr = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := p.ack(); err != nil {
+		return err
+	}
+	if ferr == nil {
+		ferr = os.Chmod(target, os.FileMode(mode))
+	}
+	if ferr == nil && !mtime.IsZero() {
+		ferr = os.Chtimes(target, mtime, mtime)
+	}
+	if ferr != nil {
+		return ferr
+	}
+	_, err = p.w.Write([]byte{0})
+	return err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Serve announces on the dial string and runs cmd for every
+// session opened by a client holding a key in authorized_keys.
+func Serve(dial string, cmd []string) error {
+	if len(cmd) == 0 {
+		return fmt.Errorf("serve: no cmd")
+	}
+	a, err := endpoint(dial, "")
+	if err != nil {
+		return err
+	}
+	key, err := hostkey(arg.hostkey)
+	if err != nil {
+		return err
+	}
+	conf := &ssh.ServerConfig{PublicKeyCallback: authorized(arg.auth)}
+	conf.AddHostKey(key)
+	log.Printf("serve: host key: %s %s", key.PublicKey().Type(), ssh.FingerprintSHA256(key.PublicKey()))
+
+	ln, err := net.Listen(a.net, a.hostport())
+	if err != nil {
+		return err
+	}
+	verb("serve: announce:", ln.Addr())
+	for {
+		fd, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer fd.Close()
+			if err := answer(fd, conf, cmd); err != nil {
+				log.Printf("serve: %s: %s", fd.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// hostkey loads the server's private key from file. If file
+// doesn't exist, a new ed25519 key is generated and written to it.
+func hostkey(file string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err == nil {
+		return ssh.ParsePrivateKey(buf)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := touch(file); err != nil {
+		return nil, err
+	}
+	buf = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(file, buf, 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("serve: created host key: %s", file)
+	return ssh.NewSignerFromKey(priv)
+}
+
+// authorized returns a callback that accepts the keys listed in
+// the authorized_keys file. The file is read on every attempt.
+func authorized(file string) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Printf("serve: %s", err)
+			return nil, err
+		}
+		want := key.Marshal()
+		for len(buf) > 0 {
+			k, _, _, rest, err := ssh.ParseAuthorizedKey(buf)
+			if err != nil {
+				break
+			}
+			if bytes.Equal(k.Marshal(), want) {
+				return &ssh.Permissions{
+					Extensions: map[string]string{"pubkey-fp": ssh.FingerprintSHA256(key)},
+				}, nil
+			}
+			buf = rest
+		}
+		return nil, fmt.Errorf("%s: key not authorized: %s", c.User(), ssh.FingerprintSHA256(key))
+	}
+}
+
+func answer(fd net.Conn, conf *ssh.ServerConfig, cmd []string) error {
+	conn, chans, reqs, err := ssh.NewServerConn(fd, conf)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("serve: %s: %s %s", conn.RemoteAddr(), conn.User(), conn.Permissions.Extensions["pubkey-fp"])
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			return err
+		}
+		s := &session{ch: ch, user: conn.User(), raddr: conn.RemoteAddr()}
+		go s.serve(reqs, cmd)
+	}
+	return nil
+}
+
+// session is a channel that runs cmd once a shell or
+// exec request arrives
+type session struct {
+	ch    ssh.Channel
+	user  string
+	raddr net.Addr
+	env   []string
+	once  sync.Once
+}
+
+func (s *session) serve(reqs <-chan *ssh.Request, cmd []string) {
+	for r := range reqs {
+		ok := true
+		switch r.Type {
+		case "pty-req":
+			var pty struct {
+				Term          string
+				Cols, Rows    uint32
+				Width, Height uint32
+				Modes         string
+			}
+			if ok = ssh.Unmarshal(r.Payload, &pty) == nil; ok {
+				s.env = append(s.env,
+					"TERM="+pty.Term,
+					"COLUMNS="+strconv.Itoa(int(pty.Cols)),
+					"LINES="+strconv.Itoa(int(pty.Rows)),
+				)
+			}
+		case "env":
+			var kv struct{ Name, Value string }
+			ok = ssh.Unmarshal(r.Payload, &kv) == nil && acceptenv(kv.Name)
+			if ok {
+				s.env = append(s.env, kv.Name+"="+kv.Value)
+			}
+		case "window-change":
+		case "shell", "exec":
+			var orig struct{ Command string }
+			if r.Type == "exec" {
+				ssh.Unmarshal(r.Payload, &orig)
+			}
+			started := false
+			s.once.Do(func() {
+				started = true
+				go s.run(cmd, orig.Command)
+			})
+			ok = started
+		default:
+			ok = false
+		}
+		if r.WantReply {
+			r.Reply(ok, nil)
+		}
+	}
+}
+
+// run runs cmd with its standard streams connected to the session
+// and sends its exit status. A command requested by the client is
+// exported as SSH_ORIGINAL_COMMAND.
+func (s *session) run(cmd []string, orig string) {
+	defer s.ch.Close()
+	host, port, _ := net.SplitHostPort(s.raddr.String())
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Env = append(os.Environ(), s.env...)
+	c.Env = append(c.Env,
+		"USER="+s.user,
+		"SSH_CLIENT="+host+" "+port,
+		"SSH_ORIGINAL_COMMAND="+orig,
+	)
+	c.Stdout, c.Stderr = s.ch, s.ch.Stderr()
+	in, err := c.StdinPipe()
+	if err == nil {
+		err = c.Start()
+	}
+	if err != nil {
+		fmt.Fprintln(s.ch.Stderr(), err)
+		s.exit(127)
+		return
+	}
+	verb("serve: run:", s.user, cmd)
+	go func() {
+		io.Copy(in, s.ch)
+		in.Close()
+	}()
+	err = c.Wait()
+	code := 0
+	var ee *exec.ExitError
+	switch {
+	case errors.As(err, &ee):
+		if code = ee.ExitCode(); code < 0 {
+			code = 255
+		}
+	case err != nil:
+		code = 255
+	}
+	verb("serve: exit:", s.user, code)
+	s.exit(code)
+}
+
+func (s *session) exit(code int) {
+	var status [4]byte
+	binary.BigEndian.PutUint32(status[:], uint32(code))
+	s.ch.SendRequest("exit-status", false, status[:])
+}
+
+// acceptenv reports whether a client may set the environment
+// variable name. Like OpenSSH's AcceptEnv, only the locale is
+// accepted, so a client can't change what cmd runs.
+func acceptenv(name string) bool {
+	return name == "LANG" || strings.HasPrefix(name, "LC_")
+}
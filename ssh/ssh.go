@@ -1,13 +1,16 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/as/mute"
 	"golang.org/x/crypto/ssh"
@@ -21,10 +24,21 @@ func init() {
 var arg struct {
 	s, u, p, c string
 	n, v       bool
+	A          bool
 	d          string
 	e          string
 	h          bool
 	q          bool
+	known      string
+	trust      string
+	L, R, D    forwards
+	serve      string
+	auth       string
+	hostkey    string
+	put, get   bool
+	hosts      string
+	report     string
+	j          int
 }
 
 var f *flag.FlagSet
@@ -35,6 +49,9 @@ type Addr struct {
 
 func dialsplit(dial string) *Addr {
 	for _, delim := range []string{"!", ":"} {
+		if !strings.Contains(dial, delim) && delim != ":" {
+			continue
+		}
 		s := strings.Split(dial, delim)
 		a := &Addr{net: "tcp", svc: "22"}
 		n := len(s)
@@ -42,7 +59,7 @@ func dialsplit(dial string) *Addr {
 		case n == 3:
 			a.svc = s[2]
 			a.addr = s[1]
-			a.svc = s[0]
+			a.net = s[0]
 			return a
 		case n == 2:
 			a.addr = s[0]
@@ -62,9 +79,21 @@ func Pass() (string, error) {
 	return arg.p, nil
 }
 
+// Signers returns the agent's signers followed by the signer
+// for the private key given with -d.
 func Signers() (signers []ssh.Signer, err error) {
+	if keyring != nil {
+		s, err := keyring.Signers()
+		if err != nil {
+			log.Printf("agent: %s", err)
+		}
+		signers = append(signers, s...)
+	}
 	if arg.d == "" {
-		return nil, fmt.Errorf("no ssh key path specified")
+		if len(signers) == 0 {
+			return nil, fmt.Errorf("no ssh key path specified")
+		}
+		return signers, nil
 	}
 	buf, err := ioutil.ReadFile(arg.d)
 	no(err)
@@ -102,7 +131,23 @@ func init() {
 	f.StringVar(&arg.d, "d", "", "")
 	f.BoolVar(&arg.n, "n", false, "")
 	f.BoolVar(&arg.v, "v", false, "")
+	f.BoolVar(&arg.A, "A", false, "")
+	f.StringVar(&arg.known, "known", sshfile("known_hosts"), "")
+	f.StringVar(&arg.trust, "trust", TrustTOFU, "")
+	f.Var(&arg.L, "L", "")
+	f.Var(&arg.R, "R", "")
+	f.Var(&arg.D, "D", "")
+	f.StringVar(&arg.serve, "serve", "", "")
+	f.BoolVar(&arg.put, "put", false, "")
+	f.BoolVar(&arg.get, "get", false, "")
+	f.StringVar(&arg.hosts, "hosts", "", "")
+	f.StringVar(&arg.report, "report", "", "")
+	f.IntVar(&arg.j, "j", 16, "")
+	f.StringVar(&arg.auth, "auth", sshfile("authorized_keys"), "")
+	f.StringVar(&arg.hostkey, "hostkey", sshfile("ssh_host_ed25519_key"), "")
+}
 
+func argparse() {
 	err := mute.Parse(f, os.Args[1:])
 	if err != nil {
 		printerr(err)
@@ -112,33 +157,51 @@ func init() {
 var addr *Addr
 
 func main() {
+	argparse()
+	if arg.serve != "" && !arg.h && !arg.q {
+		no(Serve(arg.serve, f.Args()))
+		return
+	}
+	if arg.hosts != "" && !arg.h && !arg.q {
+		os.Exit(fan(f.Args()))
+	}
 	addr = dialsplit(arg.s)
 	if arg.s == "" || arg.h || arg.q || addr == nil {
 		usage()
 		os.Exit(1)
 	}
-	config := &ssh.ClientConfig{
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		User:            arg.u,
-	}
-	if arg.d != "" {
-		config.Auth = append(config.Auth, ssh.PublicKeysCallback(Signers))
-	}
-	if arg.p != "" {
-		config.Auth = append(config.Auth, ssh.PasswordCallback(Pass))
-	}
+	config := clientconfig()
 
 	addrsvc := addr.addr + ":" + addr.svc
-	conn, err := ssh.Dial(addr.net, addrsvc, config)
+	conn, err := ssh.Dial(addr.net, addrsvc, hostconfig(config, addrsvc))
 	if err != nil {
 		no(err)
 	}
+	defer conn.Close()
+
+	if forward(conn) && len(f.Args()) == 0 {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		go func() {
+			conn.Wait()
+			sig <- nil
+		}()
+		<-sig
+		return
+	}
+
+	if arg.put || arg.get {
+		os.Exit(transfer(conn, f.Args()))
+	}
 
 	session, err := conn.NewSession()
 	if err != nil {
 		no(err)
 	}
 	defer session.Close()
+	if arg.A {
+		no(forwardagent(conn, session))
+	}
 	session.Stdin = os.Stdin
 	session.Stdout = os.Stdout
 	session.Stderr = os.Stderr
@@ -151,12 +214,141 @@ func main() {
 
 	if err != nil {
 		if arg.v {
-			no(err)
+			printerr(err)
+		}
+		var ee *ssh.ExitError
+		if errors.As(err, &ee) {
+			os.Exit(ee.ExitStatus())
 		}
 		os.Exit(1)
 	}
 }
 
+// DialTimeout bounds the time taken to connect to a host
+const DialTimeout = 15 * time.Second
+
+// clientconfig returns the client configuration from the
+// command line: the user, host key policy and auth methods
+func clientconfig() *ssh.ClientConfig {
+	hostkeys, err := HostKeys(arg.known, arg.trust)
+	no(err)
+	config := &ssh.ClientConfig{
+		HostKeyCallback: hostkeys,
+		User:            arg.u,
+		Timeout:         DialTimeout,
+	}
+	keyring = dialagent()
+	if arg.d != "" || keyring != nil {
+		config.Auth = append(config.Auth, ssh.PublicKeysCallback(Signers))
+	}
+	if arg.p != "" {
+		config.Auth = append(config.Auth, ssh.PasswordCallback(Pass))
+	}
+	return config
+}
+
+// hostconfig returns config limited to the host key types
+// known for addr
+func hostconfig(config *ssh.ClientConfig, addr string) *ssh.ClientConfig {
+	if arg.trust == TrustOff {
+		return config
+	}
+	c := *config
+	c.HostKeyAlgorithms = KnownAlgorithms(arg.known, addr)
+	return &c
+}
+
+// fan runs cmd on every host in the -hosts list and returns
+// the exit status: 0 if all succeeded, 2 if all failed, else 1.
+func fan(cmd []string) int {
+	if len(cmd) == 0 {
+		usage()
+		return 1
+	}
+	in := os.Stdin
+	if arg.hosts != "-" {
+		fd, err := os.Open(arg.hosts)
+		no(err)
+		defer fd.Close()
+		in = fd
+	}
+	list, err := hosts(in)
+	no(err)
+	result := Fan(clientconfig(), list, arg.j, strings.Join(cmd, " "))
+	if arg.report != "" {
+		fd, err := os.Create(arg.report)
+		no(err)
+		no(Report(fd, result))
+		no(fd.Close())
+	}
+	failed := 0
+	for _, r := range result {
+		if r.Err != nil {
+			printerr(r.Host + ": " + r.Err.Error())
+		}
+		if r.Status != 0 {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return 0
+	case failed == len(result):
+		return 2
+	}
+	return 1
+}
+
+// forward starts the -L, -R and -D forwards on conn. It
+// reports whether any were requested.
+func forward(conn *ssh.Client) bool {
+	for _, spec := range arg.L {
+		fw, err := parseforward(spec)
+		no(err)
+		no(Local(conn, fw))
+	}
+	for _, spec := range arg.R {
+		fw, err := parseforward(spec)
+		no(err)
+		no(Remote(conn, fw))
+	}
+	for _, spec := range arg.D {
+		no(Dynamic(conn, spec))
+	}
+	return len(arg.L)+len(arg.R)+len(arg.D) > 0
+}
+
+// transfer runs -put or -get and returns the exit status. With
+// one argument, the files to copy are read from stdin.
+func transfer(conn *ssh.Client, a []string) int {
+	var (
+		failed int
+		err    error
+	)
+	switch {
+	case len(a) == 2 && arg.put:
+		err = Put(conn, a[0], a[1])
+	case len(a) == 2:
+		err = Get(conn, a[0], a[1])
+	case len(a) == 1 && arg.put:
+		failed, err = PutList(conn, os.Stdin, a[0])
+	case len(a) == 1:
+		failed, err = GetList(conn, os.Stdin, a[0])
+	default:
+		usage()
+		return 1
+	}
+	if err != nil {
+		printerr(err)
+		return 1
+	}
+	if failed > 0 {
+		log.Printf("%d files failed", failed)
+		return 1
+	}
+	return 0
+}
+
 func atoi(s string) int {
 	n, _ := strconv.Atoi(s)
 	return n
@@ -172,19 +364,25 @@ func interactive(session *ssh.Session) error {
 		atoi(os.Getenv("COLS")),
 		modes)
 	if err != nil {
-		fmt.Errorf("session: %s", err)
+		log.Printf("session: %s", err)
 	}
 	if err := session.Shell(); err != nil {
-		return fmt.Errorf("session: %s", err)
+		return fmt.Errorf("session: %w", err)
 	}
 	if err := session.Wait(); err != nil {
-		return fmt.Errorf("session: %s", err)
+		return fmt.Errorf("session: %w", err)
 	}
 	return nil
 }
 func command(s *ssh.Session, cmd string) error {
 	return s.Run(cmd)
 }
+func verb(v ...interface{}) {
+	if arg.v {
+		log.Println(v...)
+	}
+}
+
 func printerr(v ...interface{}) {
 	fmt.Fprintln(os.Stderr, v...)
 }
@@ -193,12 +391,18 @@ func println(v ...interface{}) {
 }
 
 func usage() {
-	fmt.Println(`
+	fmt.Print(`
 NAME
 	ssh - ssh client
  
 SYNOPSIS
 	ssh [-s host:port -u user] [-p pass | -d key.pem] [cmd]
+	ssh [-s host:port -u user] [-L fwd] [-R fwd] [-D port] [cmd]
+	ssh -serve [net!]host!port [-auth file] [-hostkey file] cmd
+	ssh [-s host:port -u user] -put local remote
+	ssh [-s host:port -u user] -get remote local
+	walk -f | ssh [-s host:port -u user] -put remotedir/
+	ssh -hosts file [-j n] [-report file] [-u user] cmd
 
 DESCRIPTION
 	Ssh connects to the host and starts the ssh
@@ -210,6 +414,14 @@ OPTIONS
 	-u user     The username
 	-p pass     The password
 	-d key.pem  Path to the private key (overrides password)
+	-A          Forward the ssh-agent to the remote session
+
+	-known file  Path to known_hosts (default ~/.ssh/known_hosts)
+	-trust mode  Host key trust mode: strict, tofu or off (default tofu)
+
+	-L fwd      Forward local port to host:rport: lport:host:rport
+	-R fwd      Forward remote port to host:lport: rport:host:lport
+	-D port     Run a local SOCKS5 proxy that dials through the host
 
 	If any of the above options are empty, ssh
 	reads from environment variables:
@@ -218,6 +430,69 @@ OPTIONS
 	$user   The username
 	$pass   The password
 
+FILE TRANSFER
+	With -put and -get, ssh copies files with the scp protocol,
+	preserving their mode and modification time. The remote host
+	must have scp installed.
+
+	Given one argument, the names of the files to copy are read
+	from stdin, one per line, in the format written by walk -f. Each
+	file is copied into the directory, which must exist, and keeps
+	its relative path; missing subdirectories are created. With
+	-put, the names are local files; with -get, they are remote files.
+	An error in one file is reported and the remaining files are
+	copied. The exit status is 1 if any file failed.
+
+FAN OUT
+	With -hosts file, ssh runs cmd on every host listed in the
+	file, one dial string per line. If file is -, the list is read
+	from stdin. At most n hosts (-j, default 16) run cmd at once.
+	Each line of output is prefixed with the host and a tab, and
+	stderr is prefixed the same way.
+
+	With -report file, ssh writes one tab-separated line per host:
+	the host, its exit status, and ok, exit or the error that stopped
+	cmd from running. The exit status of ssh is 0 if cmd succeeded on
+	every host, 2 if it failed on every host, and 1 otherwise.
+
+SERVER
+	With -serve, ssh announces on the dial string and runs cmd for
+	every session opened by a client whose key is in the -auth file
+	(default ~/.ssh/authorized_keys). The file is read on each login.
+	The host key is read from -hostkey (default
+	~/.ssh/ssh_host_ed25519_key) and generated if it doesn't exist.
+
+	Cmd's stdin, stdout, stderr and exit status are connected to the
+	session. A command sent by the client is not run, but exported
+	to cmd as $SSH_ORIGINAL_COMMAND. Pty requests are accepted without
+	allocating a terminal: the terminal type and size are exported
+	as $TERM, $COLUMNS and $LINES. Of the variables the client
+	sends, only $LANG and $LC_* are exported.
+
+AGENT
+	If $SSH_AUTH_SOCK names a running ssh-agent, ssh tries the
+	agent's keys first, then the key given with -d, and finally
+	the password.
+
+FORWARDING
+	The -L, -R and -D options may be repeated. A forward is either
+	in the OpenSSH form [bind:]port:host:hostport, or a pair of dial
+	strings separated by a comma, the listening endpoint first:
+
+	tcp!*!3389,tcp!10.2.64.20!3389
+
+	Without cmd, ssh forwards until interrupted. With cmd, ssh
+	forwards until cmd exits.
+
+HOST KEYS
+	Host keys are verified against the OpenSSH known_hosts file,
+	including hashed hostnames. In strict mode, ssh refuses hosts
+	not in the file. In tofu mode, ssh trusts an unknown host on
+	first use and appends its key to the file with a hashed hostname.
+	A host key that differs from the known key is always refused, and
+	both fingerprints are printed. Off disables verification and is
+	open to man-in-the-middle attacks.
+
 EXAMPLES
 	On Windows:
 
@@ -231,5 +506,22 @@ EXAMPLES
 	With command line arguments
 
 	ssh -s tcp!10.2.77.43!3389 -u root -p insecurity
+
+	Tunnel RDP on a host behind 10.2.77.43 to local port 3389
+
+	ssh -s tcp!10.2.77.43!22 -u root -L 3389:10.2.64.20:3389
+
+	Copy a source tree to the remote host
+
+	walk -f src | ssh -s tcp!10.2.77.43!22 -u root -put /tmp/
+
+	Run uptime on every lab machine, four at a time, and save
+	the exit status of each one
+
+	ssh -hosts lab.txt -j 4 -report status.tsv -u root uptime
+
+	Expose a shell to colleagues listed in authorized_keys
+
+	ssh -serve tcp!*!2222 sh
 `)
 }
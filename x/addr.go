@@ -26,6 +26,8 @@ type Line struct {
 }
 type Dot struct {
 }
+type Mark struct {
+}
 type Compound struct {
 	a0, a1 Address
 	op     byte
@@ -35,6 +37,7 @@ func (r Regexp) Back() bool   { return r.rel == -1 }
 func (b Byte) Back() bool     { return b.rel == -1 }
 func (l Line) Back() bool     { return l.rel == -1 }
 func (d Dot) Back() bool      { return false }
+func (m Mark) Back() bool     { return false }
 func (c Compound) Back() bool { return c.a1.Back() }
 
 // Put
@@ -115,3 +118,7 @@ func (r *Line) Set(f File) {
 
 func (Dot) Set(f File) {
 }
+
+func (Mark) Set(f File) {
+	f.Select(f.Mark())
+}
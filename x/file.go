@@ -5,6 +5,14 @@ type File interface {
 	Delete(q0, q1 int64) (del int64)
 	Select(q0, q1 int64)
 	Dot() (q0, q1 int64)
+	SetMark(q0, q1 int64)
+	Mark() (q0, q1 int64)
 	Dirty() bool
+	Name() string
+	Put() error
 	Bytes() []byte
 }
+
+// files are the files named on the command line. X and Y
+// select from these.
+var files []File
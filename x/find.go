@@ -50,6 +50,9 @@ func findline2(N int64, r io.Reader) (q0, q1 int64) {
 }
 
 func findline(N int64, p []byte) (q0, q1 int64) {
+	if N == 0 {
+		return 0, 0
+	}
 	nl := int64(0)
 	l := int64(len(p))
 	for ; q1 < l; q1++ {
@@ -58,16 +61,9 @@ func findline(N int64, p []byte) (q0, q1 int64) {
 		}
 		nl++
 		if nl == N {
-			if q0 != 0 {
-				q0++
-			}
-			q1++
-			break
+			return q0, q1 + 1
 		}
-		q0 = q1
-	}
-	if q1 >= l {
-		q0++
+		q0 = q1 + 1
 	}
-	return q0, q1
+	return q0, l
 }
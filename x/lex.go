@@ -15,7 +15,7 @@ type item struct {
 }
 
 func (i item) String() string {
-	return fmt.Sprintf("%s %s", i.kind, i.value)
+	return fmt.Sprintf("%d %s", i.kind, i.value)
 }
 
 const MaxBytes = 1<<63 - 1
@@ -45,6 +45,9 @@ const (
 	kindLineOffset
 	kindCmd
 	kindArg
+	kindMark
+	kindCount
+	kindGlobal
 )
 const (
 	eof   = '\x00'
@@ -56,6 +59,7 @@ const (
 	colon = ':'
 	semi  = ';'
 	hash  = '#'
+	quote = '\''
 )
 
 type statefn func(*lexer) statefn
@@ -120,6 +124,22 @@ func (l *lexer) acceptUntil(delim string) {
 	l.backup()
 }
 
+// acceptDelim accepts up to, but not including, the unescaped
+// delimiter r. It returns false if the input ends first.
+func (l *lexer) acceptDelim(r rune) bool {
+	for {
+		switch l.next() {
+		case eof:
+			return false
+		case '\\':
+			l.next()
+		case r:
+			l.backup()
+			return true
+		}
+	}
+}
+
 func (l *lexer) acceptEOF() {
 	lim := 8192
 	i := 0
@@ -145,6 +165,12 @@ func (l *lexer) emit(t Kind) {
 	l.start = l.pos
 }
 
+// emitRaw is like emit, but doesn't interpret escape sequences
+func (l *lexer) emitRaw(t Kind) {
+	l.items <- item{t, l.String()}
+	l.start = l.pos
+}
+
 func (l *lexer) inject(it item) {
 	l.items <- it
 }
@@ -189,7 +215,7 @@ const (
 	Rcmd    = Ralpha + "<>|"
 	Rdigit  = "0123456789"
 	Rop     = "+-;,"
-	Rmod    = "#/?"
+	Rmod    = "#/?'"
 	Rescape = `#/?+-;,\abnrtx`
 )
 
@@ -230,6 +256,10 @@ func lexAddr(l *lexer) statefn {
 		l.accept(".")
 		l.emit(kindDot)
 		return lexOp
+	case quote:
+		l.accept("'")
+		l.emit(kindMark)
+		return lexOp
 	case hash:
 		l.accept("#")
 		l.ignore()
@@ -256,6 +286,14 @@ func lexCmd(l *lexer) statefn {
 		l.emit(kindEof)
 		return nil
 	}
+	if l.peek() == 's' {
+		return lexSubst
+	}
+	if strings.ContainsRune(Rdigit+Rop+Rmod, l.peek()) {
+		// an address for the next command in the chain
+		l.first = true
+		return lexAddr
+	}
 	if !l.accept(Ralpha) {
 		if l.accept("|<>") {
 			l.emit(kindCmd)
@@ -264,6 +302,16 @@ func lexCmd(l *lexer) statefn {
 		return l.errorf("bad command")
 	}
 	l.emit(kindCmd)
+	switch l.input[l.pos-1] {
+	case 'd', 'f', 'k':
+		return lexCmd
+	case 'e':
+		return lexArg2
+	case 'g', 'v', 'x', 'y', 'X', 'Y':
+		if l.peek() != eof {
+			return lexRegexpArg
+		}
+	}
 	switch l.peek() {
 	case eof:
 		l.emit(kindEof)
@@ -273,6 +321,31 @@ func lexCmd(l *lexer) statefn {
 	}
 }
 
+// lexSubst lexes s[n]/re/repl/[g]. The count and global
+// flag are always emitted, even if they are empty.
+func lexSubst(l *lexer) statefn {
+	l.accept("s")
+	l.emit(kindCmd)
+	l.acceptRun(Rdigit)
+	l.emitRaw(kindCount)
+	r := l.next()
+	if r == eof || r == '\\' || space(r) || strings.ContainsRune(Ralpha+Rdigit, r) {
+		return l.errorf("s: bad delimiter")
+	}
+	l.ignore()
+	for i := 0; i < 2; i++ {
+		if !l.acceptDelim(r) {
+			return l.errorf("s: missing terminating %q", r)
+		}
+		l.emitRaw(kindArg)
+		l.next()
+		l.ignore()
+	}
+	l.accept("g")
+	l.emitRaw(kindGlobal)
+	return lexCmd
+}
+
 func lexOp(l *lexer) statefn {
 	ignoreSpaces(l)
 	if l.peek() == eof {
@@ -311,6 +384,20 @@ func lexArg(l *lexer) statefn {
 	return lexCmd
 }
 
+// lexRegexpArg lexes a delimited regular expression. It is
+// emitted as-is, except that the delimiter may be escaped.
+func lexRegexpArg(l *lexer) statefn {
+	r := l.next()
+	l.ignore()
+	if !l.acceptDelim(r) {
+		return l.errorf("missing terminating %q", r)
+	}
+	l.emitRaw(kindArg)
+	l.next()
+	l.ignore()
+	return lexCmd
+}
+
 func lexArg2(l *lexer) statefn {
 	l.acceptEOF()
 	l.emit(kindArg)
@@ -1,29 +1,257 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"flag"
+	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
 	"strings"
+
+	"github.com/as/mute"
 )
 
+const Prefix = "x: "
+
+var args struct {
+	h, q bool
+	s    bool
+}
+
+var f *flag.FlagSet
+
+// out is the standard output shared by every command
+var out = bufio.NewWriter(os.Stdout)
+
+func init() {
+	f = flag.NewFlagSet("main", flag.ContinueOnError)
+	f.BoolVar(&args.h, "h", false, "")
+	f.BoolVar(&args.q, "?", false, "")
+	f.BoolVar(&args.s, "s", false, "")
+}
+
+func argparse() {
+	err := mute.Parse(f, os.Args[1:])
+	if err != nil {
+		printerr(err)
+		os.Exit(1)
+	}
+	if args.h || args.q {
+		usage()
+		os.Exit(0)
+	}
+}
+
 func main() {
-	in := os.Stdin
-	out := os.Stdout
-	var p [65536]byte
-	w := &Win{R: nil, Q0: 0, Q1: 0}
-	cmd := Cmdparse(strings.Join(os.Args[1:], " "))
-	for {
-		n, err := in.Read(p[:])
+	argparse()
+	a := f.Args()
+	var names []string
+	if len(a) > 1 {
+		// x command file ...
+		a, names = a[:1], a[1:]
+	}
+	if args.s && len(names) > 0 {
+		printerr("-s reads stdin, not files")
+		os.Exit(1)
+	}
+	script := compileScript(strings.Join(a, " "))
+	switch {
+	case args.s:
+		no(stream(script, out, os.Stdin))
+	case len(names) > 0:
+		if !load(names...) {
+			status = 1
+		}
+		for _, cmd := range script {
+			run(cmd)
+		}
+	default:
+		data, err := ioutil.ReadAll(os.Stdin)
+		no(err)
+		w := &Win{R: data}
+		files = []File{w}
+		for _, cmd := range script {
+			cmd.fn(w)
+		}
+		_, err = out.Write(w.Bytes())
+		no(err)
+	}
+	no(out.Flush())
+	os.Exit(status)
+}
+
+// compileScript compiles each line of s as a separate command
+func compileScript(s string) (script []*Command) {
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		cmd, err := Cmdparse(line)
 		if err != nil {
-			if err != io.EOF {
-				log.Println(err)
+			printerr(fmt.Sprintf("%q:", line), err)
+			os.Exit(1)
+		}
+		script = append(script, cmd)
+	}
+	if len(script) == 0 {
+		printerr("no command")
+		os.Exit(1)
+	}
+	return script
+}
+
+// load reads the named files, or the list of files on
+// stdin for "-", into memory. It returns false if any
+// file couldn't be read.
+func load(names ...string) (ok bool) {
+	ok = true
+	for _, name := range names {
+		if name != "-" {
+			ok = loadfile(name) && ok
+			continue
+		}
+		sc := bufio.NewScanner(os.Stdin)
+		for sc.Scan() {
+			if name := strings.TrimSpace(sc.Text()); name != "" {
+				ok = loadfile(name) && ok
 			}
-			return
 		}
-		w.R = p[:n]
-		cmd.fn(w)
-		io.Copy(out, bytes.NewReader(w.Bytes()))
+		if err := sc.Err(); err != nil {
+			printerr("-:", err)
+			ok = false
+		}
 	}
+	return ok
+}
+
+func loadfile(name string) bool {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		printerr(err)
+		return false
+	}
+	files = append(files, &Win{R: data, Path: name})
+	return true
+}
+
+// run runs cmd once if it selects its own files with X or Y,
+// otherwise it runs once on every file.
+func run(cmd *Command) {
+	if cmd.s == "X" || cmd.s == "Y" {
+		cmd.fn(&Win{})
+		return
+	}
+	for _, f := range files {
+		cmd.fn(f)
+	}
+}
+
+// stream runs the script on each newline-terminated record in r
+// independently. The last record may lack a newline. Output
+// is flushed whenever the reader would block.
+func stream(script []*Command, out *bufio.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	w := &Win{}
+	files = []File{w}
+	for {
+		rec, err := br.ReadBytes('\n')
+		if len(rec) > 0 {
+			w.R = rec
+			w.Select(0, 0)
+			for _, cmd := range script {
+				cmd.fn(w)
+			}
+			if _, err := out.Write(w.Bytes()); err != nil {
+				return err
+			}
+			if br.Buffered() == 0 {
+				out.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func usage() {
+	fmt.Print(`
+NAME
+	x - structural regular expressions
+
+SYNOPSIS
+	x [-s] command
+	x command file ...
+
+DESCRIPTION
+	X reads stdin, applies the Sam command to it, and writes
+	the result to stdout. By default, the command runs once
+	on the entire input, so addresses and regular expressions
+	may span any number of lines.
+
+	The -s flag streams the input instead. The command runs
+	independently on each line, so addresses are relative
+	to the line and x uses constant memory. Only line-local
+	commands are meaningful in this mode.
+
+	Given a list of files, x edits them in memory instead. A
+	dash reads the list from stdin (see walk -h). Nothing is
+	printed or written unless the command asks for it with
+	f or w. A command that doesn't begin with X or Y runs on
+	every file.
+
+	Commands on one line run in turn, each starting from the
+	dot the last one left. A looping command (g v x y X Y)
+	runs the rest of the line as its body, and X or Y may only
+	begin a line. Each line of the command is run in turn, so
+	one script can report, edit and then save its files.
+
+FLAGS
+	-s    Stream the input, applying the command to each line
+
+COMMANDS
+	a/text/ i/text/ c/text/    Append, insert, or change dot
+	d                          Delete dot
+	s[n]/re/repl/[g]           Substitute the nth (all) matches
+	e file                     Replace the input with file
+	r/file/ w/file/            Read file into, or write dot to, file
+	w                          Write a modified file back to itself
+	f                          Print the file name
+	k                          Set the mark (') to dot
+	m addr  t addr             Move or copy dot after addr
+	x/re/ y/re/ cmd            Run cmd on each match (or between)
+	g/re/ v/re/ cmd            Run cmd if dot does (not) match
+	X/re/ Y/re/ cmd            Run cmd on files whose names do (not) match
+	| cmd  > file              Pipe dot through cmd, or write to file
+
+EXAMPLE
+	# Rename a function in a large file
+	x ',x/oldname/ c/newname/' < main.go
+
+	# Swap the first two fields on every line of a log
+	tail -f log | x -s ',s/^(\S+) (\S+)/\2 \1/'
+
+	# List the go files with TODOs, then mark them done
+	walk -f | x 'X/\.go$/ ,x/TODO/ f
+	X/\.go$/ ,x/TODO/ c/DONE/
+	X/\.go$/ w' -
+
+`)
+}
+
+func no(err error) {
+	if err != nil {
+		printerr(err)
+		os.Exit(1)
+	}
+}
+
+func printerr(v ...interface{}) {
+	fmt.Fprint(os.Stderr, Prefix)
+	fmt.Fprintln(os.Stderr, v...)
 }
@@ -31,11 +31,17 @@ func (p *parser) mustatoi(s string) int64 {
 	}
 	return int64(i)
 }
+
+// fatal records the first error found while parsing
 func (p *parser) fatal(why interface{}) {
+	if p.err != nil {
+		return
+	}
 	switch why := why.(type) {
+	case error:
+		p.err = why
 	default:
-		//fmt.Println(why)
-		why = why
+		p.err = fmt.Errorf("%v", why)
 	}
 }
 
@@ -112,6 +118,8 @@ func parseSimpleAddr(p *parser) (a Address) {
 		return &Byte{i, rel}
 	case kindDot:
 		return &Dot{}
+	case kindMark:
+		return &Mark{}
 	}
 	p.err = fmt.Errorf("bad address")
 	return
@@ -125,6 +133,9 @@ type Command struct {
 }
 
 func (c *Command) Next() func(File) {
+	if c.next == nil {
+		return nil
+	}
 	return c.next.fn
 }
 func (c *Command) n() *Command {
@@ -147,6 +158,15 @@ func n(i ...interface{}) (n int, err error) {
 
 var eprint = n
 
+// status is the exit status of x: 1 if any command failed
+var status int
+
+// fail reports a command that couldn't be carried out
+func fail(v ...interface{}) {
+	printerr(v...)
+	status = 1
+}
+
 // Put
 func parseCmd(p *parser) (c *Command) {
 	c = new(Command)
@@ -160,11 +180,11 @@ func parseCmd(p *parser) (c *Command) {
 		c.fn = func(f File) {
 			q0, q1 := f.Dot()
 			b := []byte(argv)
-			if v == "i" {
-				f.Insert(b, q0)
-			} else {
-				f.Insert(b, q1)
+			if v == "a" {
+				q0 = q1
 			}
+			f.Insert(b, q0)
+			f.Select(q0, q0+int64(len(b)))
 		}
 		return
 	case "c":
@@ -174,24 +194,99 @@ func parseCmd(p *parser) (c *Command) {
 			q0, q1 := f.Dot()
 			f.Delete(q0, q1)
 			f.Insert([]byte(argv), q0)
+			f.Select(q0, q0+int64(len(argv)))
 		}
 		return
 	case "d":
 		c.fn = func(f File) {
 			q0, q1 := f.Dot()
 			f.Delete(q0, q1)
+			f.Select(q0, q0)
 		}
 		return
 	case "e":
+		argv := strings.TrimSpace(parseArg(p))
+		c.args = argv
+		c.fn = func(f File) {
+			data, err := ioutil.ReadFile(argv)
+			if err != nil {
+				fail(err)
+				return
+			}
+			f.Delete(0, int64(len(f.Bytes())))
+			f.Insert(data, 0)
+			f.Select(0, 0)
+		}
+		return
+	case "f":
+		c.fn = func(f File) {
+			fmt.Fprintln(out, f.Name())
+		}
+		return
 	case "k":
+		c.fn = func(f File) {
+			f.SetMark(f.Dot())
+		}
+		return
 	case "s":
+		count := parseArg(p)
+		sre := parseArg(p)
+		repl := parseArg(p)
+		global := parseArg(p) == "g"
+		if p.tok.kind != kindGlobal {
+			p.fatal(fmt.Errorf("s: bad syntax"))
+			return
+		}
+		c.args = sre
+		nth := 1
+		if count != "" {
+			nth = int(p.mustatoi(count))
+		}
+		if nth < 1 || sre == "" {
+			p.fatal(fmt.Errorf("s: bad count or empty regexp"))
+			return
+		}
+		re, err := regexp.Compile(sre)
+		if err != nil {
+			p.fatal(err)
+			return
+		}
+		tmpl := compileRepl(repl)
+		c.fn = func(f File) {
+			q0, q1 := f.Dot()
+			b := f.Bytes()[q0:q1]
+			lim := nth
+			if global {
+				lim = -1
+			}
+			var out []byte
+			last, nsub := 0, 0
+			for i, m := range re.FindAllSubmatchIndex(b, lim) {
+				if i+1 < nth {
+					continue
+				}
+				out = append(out, b[last:m[0]]...)
+				out = re.Expand(out, tmpl, b, m)
+				last = m[1]
+				nsub++
+			}
+			if nsub == 0 {
+				eprint("s: no match")
+				return
+			}
+			out = append(out, b[last:]...)
+			f.Delete(q0, q1)
+			f.Insert(out, q0)
+			f.Select(q0, q0+int64(len(out)))
+		}
+		return
 	case "r":
 		argv := parseArg(p)
 		c.args = argv
 		c.fn = func(f File) {
 			data, err := ioutil.ReadFile(c.args)
 			if err != nil {
-				eprint(err)
+				fail(err)
 				return
 			}
 			q0, q1 := f.Dot()
@@ -205,16 +300,24 @@ func parseCmd(p *parser) (c *Command) {
 		argv := parseArg(p)
 		c.args = argv
 		c.fn = func(f File) {
+			if argv == "" {
+				if f.Dirty() && f.Name() != "" {
+					if err := f.Put(); err != nil {
+						fail(err)
+					}
+				}
+				return
+			}
 			fd, err := os.Create(argv)
 			if err != nil {
-				eprint(err)
+				fail(err)
 				return
 			}
 			defer fd.Close()
 			q0, q1 := f.Dot()
 			_, err = io.Copy(fd, bytes.NewReader(f.Bytes()[q0:q1]))
 			if err != nil {
-				eprint(err)
+				fail(err)
 			}
 		}
 		return
@@ -242,13 +345,14 @@ func parseCmd(p *parser) (c *Command) {
 	case "g":
 		argv := parseArg(p)
 		c.args = argv
+		re, err := regexp.Compile(argv)
+		if err != nil {
+			p.fatal(err)
+			return
+		}
 		c.fn = func(f File) {
 			q0, q1 := f.Dot()
-			ok, err := regexp.Match(argv, f.Bytes()[q0:q1])
-			if err != nil {
-				panic(err)
-			}
-			if ok {
+			if re.Match(f.Bytes()[q0:q1]) {
 				if nextfn := c.Next(); nextfn != nil {
 					nextfn(f)
 				}
@@ -258,13 +362,14 @@ func parseCmd(p *parser) (c *Command) {
 	case "v":
 		argv := parseArg(p)
 		c.args = argv
+		re, err := regexp.Compile(argv)
+		if err != nil {
+			p.fatal(err)
+			return
+		}
 		c.fn = func(f File) {
 			q0, q1 := f.Dot()
-			ok, err := regexp.Match(argv, f.Bytes()[q0:q1])
-			if err != nil {
-				panic(err)
-			}
-			if !ok {
+			if !re.Match(f.Bytes()[q0:q1]) {
 				if nextfn := c.Next(); nextfn != nil {
 					nextfn(f)
 				}
@@ -277,7 +382,8 @@ func parseCmd(p *parser) (c *Command) {
 		c.fn = func(f File) {
 			x := strings.Fields(argv)
 			if len(x) == 0 {
-				eprint("|: nothing on rhs")
+				fail("|: nothing on rhs")
+				return
 			}
 			n := x[0]
 			var a []string
@@ -291,7 +397,7 @@ func parseCmd(p *parser) (c *Command) {
 			cmd.Stdout = buf
 			err := cmd.Run()
 			if err != nil {
-				eprint(err)
+				fail(err)
 			}
 			f.Delete(q0, q1)
 			f.Insert(buf.Bytes(), q0)
@@ -304,14 +410,34 @@ func parseCmd(p *parser) (c *Command) {
 		c.fn = func(f File) {
 			fd, err := os.Create(argv)
 			if err != nil {
-				eprint(err)
+				fail(err)
 				return
 			}
 			defer fd.Close()
 			q0, q1 := f.Dot()
 			_, err = io.Copy(fd, bytes.NewReader(f.Bytes()[q0:q1]))
 			if err != nil {
-				eprint(err)
+				fail(err)
+			}
+		}
+		return
+	case "X", "Y":
+		argv := parseArg(p)
+		c.args = argv
+		re, err := regexp.Compile(argv)
+		if err != nil {
+			p.fatal(err)
+			return
+		}
+		c.fn = func(File) {
+			nextfn := c.Next()
+			if nextfn == nil {
+				return
+			}
+			for _, f := range files {
+				if re.MatchString(f.Name()) == (v == "X") {
+					nextfn(f)
+				}
 			}
 		}
 		return
@@ -327,7 +453,7 @@ func parseCmd(p *parser) (c *Command) {
 			q0, q1 := f.Dot()
 			x0, x1 := q0, q0
 			for {
-				if x1 > q1 {
+				if x1 < 0 || x1 > q1 || q1 > int64(len(f.Bytes())) {
 					break
 				}
 				buf := bytes.NewReader(f.Bytes()[x1:q1])
@@ -363,7 +489,7 @@ func parseCmd(p *parser) (c *Command) {
 			x0, x1 := q0, q0
 			y0, y1 := q0, q0
 			for {
-				if x1 > q1 {
+				if x1 < 0 || x1 > q1 || q1 > int64(len(f.Bytes())) {
 					break
 				}
 				buf := bytes.NewReader(f.Bytes()[x1:q1])
@@ -400,7 +526,14 @@ func parseCmd(p *parser) (c *Command) {
 
 func (p *parser) Next() *item {
 	p.last = p.tok
-	p.tok = <-p.in
+	tok, ok := <-p.in
+	if !ok {
+		tok = item{kind: kindEof}
+	}
+	if tok.kind == kindErr {
+		p.fatal(tok.value)
+	}
+	p.tok = tok
 	return &p.tok
 }
 
@@ -414,27 +547,46 @@ func parse(i chan item) *parser {
 }
 
 func (p *parser) run() {
+	defer close(p.stop)
 	tok := p.Next()
-	if tok.kind == kindEof || p.err != nil {
-		if tok.kind == kindEof {
-			//			p.fatal(fmt.Errorf("run: unexpected eof"))
-			return
-		}
-		//		p.fatal(fmt.Errorf("run: %s", p.err))
+	if tok.kind == kindEof {
+		p.fatal("empty command")
+	}
+	if p.err != nil {
+		p.stop <- p.err
 		return
 	}
 	p.addr = parseAddr(p)
 	for {
+		var a Address
+		if k := p.tok.kind; k != kindCmd && k != kindEof && k != kindErr {
+			a = parseAddr(p)
+		}
 		c := parseCmd(p)
 		if c == nil {
+			if p.tok.kind != kindEof {
+				p.fatal(fmt.Errorf("bad command: %q", p.tok.value))
+			}
 			break
 		}
+		if len(p.cmd) > 0 && (c.s == "X" || c.s == "Y") {
+			p.fatal(c.s + " must begin the command")
+			break
+		}
+		if fn := c.fn; a != nil && fn != nil {
+			c.fn = func(f File) {
+				a.Set(f)
+				fn(f)
+			}
+		}
 		p.cmd = append(p.cmd, c)
 		//		eprint(fmt.Sprintf("(%s) %#v and cmd is %#v\n", tok, p.addr, c))
 		p.Next()
 	}
+	if len(p.cmd) == 0 {
+		p.fatal("no command")
+	}
 	p.stop <- p.err
-	close(p.stop)
 }
 
 func compileAddr(a Address) func(f File) {
@@ -442,34 +594,90 @@ func compileAddr(a Address) func(f File) {
 }
 
 func compile(p *parser) (cmd *Command) {
-	for i := range p.cmd {
-		if i+1 == len(p.cmd) {
-			break
-		}
-		p.cmd[i].next = p.cmd[i+1]
-	}
+	body := seq(p.cmd)
 	fn := func(f File) {
 		addr := compileAddr(p.addr)
 		if addr != nil {
 			addr(f)
 		}
-		if p.cmd != nil && p.cmd[0] != nil && p.cmd[0].fn != nil {
-			p.cmd[0].fn(f)
+		body(f)
+	}
+	cmd = &Command{fn: fn}
+	if len(p.cmd) > 0 && p.cmd[0] != nil {
+		cmd.s = p.cmd[0].s
+	}
+	return cmd
+}
+
+// seq links cmds into a function that runs them in turn. A
+// looping command takes the rest of the sequence as its body.
+func seq(cmds []*Command) func(File) {
+	for i, c := range cmds {
+		if loops(c) {
+			c.next = &Command{fn: seq(cmds[i+1:])}
+			cmds = cmds[:i+1]
+			break
+		}
+	}
+	return func(f File) {
+		for _, c := range cmds {
+			if c.fn != nil {
+				c.fn(f)
+			}
 		}
 	}
-	return &Command{fn: fn}
 }
 
-func Cmdparse(s string) (cmd *Command) {
+func loops(c *Command) bool {
+	return len(c.s) == 1 && strings.Contains("gvxyXY", c.s)
+}
+
+func Cmdparse(s string) (cmd *Command, err error) {
 	return cmdparse(s)
 }
-func cmdparse(s string) (cmd *Command) {
+func cmdparse(s string) (cmd *Command, err error) {
 	_, itemc := lex("cmd", s)
 	p := parse(itemc)
-	err := <-p.stop
-	if err != nil {
-		eprint(err)
-		return nil
+	if err = <-p.stop; err != nil {
+		return nil, err
+	}
+	return compile(p), nil
+}
+
+// compileRepl converts a Sam replacement string to a template
+// for regexp.Expand: & is the match, \1-\9 are submatches, \n
+// and \t are newline and tab, and any other escaped character
+// stands for itself.
+func compileRepl(s string) []byte {
+	t := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '&':
+			t = append(t, "${0}"...)
+		case '$':
+			t = append(t, "$$"...)
+		case '\\':
+			if i+1 == len(s) {
+				t = append(t, c)
+				break
+			}
+			i++
+			switch c = s[i]; {
+			case c >= '0' && c <= '9':
+				t = append(t, "${"...)
+				t = append(t, c, '}')
+			case c == 'n':
+				t = append(t, '\n')
+			case c == 't':
+				t = append(t, '\t')
+			case c == '$':
+				t = append(t, "$$"...)
+			default:
+				t = append(t, c)
+			}
+		default:
+			t = append(t, c)
+		}
 	}
-	return compile(p)
+	return t
 }
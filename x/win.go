@@ -1,8 +1,16 @@
 package main
 
+import (
+	"io/ioutil"
+	"os"
+)
+
 type Win struct {
 	Q0, Q1 int64
+	M0, M1 int64
 	R      []byte
+	Path   string
+	dirty  bool
 }
 
 func (w *Win) Select(q0, q1 int64) {
@@ -18,26 +26,25 @@ func (w *Win) Insert(s []byte, q0 int64) int64 {
 	if q0 > nr {
 		q0 = nr
 	}
-	back := []byte{}
-	if q0 < nr-1 {
-		back = w.R[q0:]
-	}
-	if w.R == nil {
-		w.R = []byte{}
-	}
-	w.R = append(w.R[:q0], append(s, back...)...)
-	return int64(len(s))
+	// s may alias w.R, so copy it before shifting
+	s = append([]byte(nil), s...)
+	w.R = append(w.R, s...)
+	copy(w.R[q0+n:], w.R[q0:nr])
+	copy(w.R[q0:], s)
+	w.dirty = true
+	return n
 }
 
 func (w *Win) Delete(q0, q1 int64) int64 {
 	n := q1 - q0
-	if n == 0 {
+	if n <= 0 {
 		return 0
 	}
 
 	Nr := int64(len(w.R))
 	copy(w.R[q0:], w.R[q1:][:Nr-q1])
 	w.R = w.R[:Nr-n]
+	w.dirty = true
 	return n
 }
 
@@ -48,8 +55,36 @@ func (w *Win) Dot() (q0, q1 int64) {
 	return
 }
 
+func (w *Win) SetMark(q0, q1 int64) {
+	w.M0, w.M1 = q0, q1
+}
+
+func (w *Win) Mark() (q0, q1 int64) {
+	nr := int64(len(w.R))
+	q0 = clamp(w.M0, 0, nr)
+	q1 = clamp(w.M1, 0, nr)
+	return
+}
+
 func (w *Win) Dirty() bool {
-	return false
+	return w.dirty
+}
+
+func (w *Win) Name() string {
+	return w.Path
+}
+
+// Put writes the buffer back to the file it came from
+func (w *Win) Put() error {
+	fi, err := os.Stat(w.Path)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(w.Path, w.R, fi.Mode().Perm())
+	if err == nil {
+		w.dirty = false
+	}
+	return err
 }
 
 func (w *Win) Bytes() []byte {
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// edit runs each line of script on a window holding in
+// and returns the result
+func edit(script, in string) (string, error) {
+	w := &Win{R: []byte(in)}
+	files = []File{w}
+	for _, line := range splitlines(script) {
+		cmd, err := Cmdparse(line)
+		if err != nil {
+			return "", err
+		}
+		cmd.fn(w)
+	}
+	return string(w.Bytes()), nil
+}
+
+func splitlines(s string) (l []string) {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' {
+			l = append(l, s[:i])
+			s = s[i+1:]
+			i = -1
+		}
+	}
+	return append(l, s)
+}
+
+func testedit(t *testing.T, tab [][3]string) {
+	t.Helper()
+	for _, v := range tab {
+		script, in, want := v[0], v[1], v[2]
+		have, err := edit(script, in)
+		if err != nil {
+			t.Logf("%q: %s", script, err)
+			t.Fail()
+			continue
+		}
+		if have != want {
+			t.Logf("%q on %q: have %q, want %q", script, in, have, want)
+			t.Fail()
+		}
+	}
+}
+
+func TestSubst(t *testing.T) {
+	testedit(t, [][3]string{
+		{`,s/o/0/`, "foo boo", "f0o boo"},
+		{`,s2/o/0/`, "foo boo", "fo0 boo"},
+		{`,s3/o/0/`, "foo boo", "foo b0o"},
+		{`,s/o/0/g`, "foo boo", "f00 b00"},
+		{`,s2/o/0/g`, "foo boo", "fo0 b00"},
+		{`,s/boo/[&]/`, "foo boo", "foo [boo]"},
+		{`,s/o/\&/`, "foo", "f&o"},
+		{`,s/(f)(o+)/\2\1/`, "foo boo", "oof boo"},
+		{`,s/o/$1/`, "foo", "f$1o"},
+		{`,s/ /\n/g`, "a b c", "a\nb\nc"},
+		{`,s:/:\::g`, "a/b/c", "a:b:c"},
+		{`,s/\//-/`, "a/b", "a-b"},
+		{`,s/^(\S+) (\S+)/\2 \1/`, "one two three", "two one three"},
+		{`,s/zz/0/`, "foo", "foo"},
+		{`2s/o/0/`, "foo\nboo\n", "foo\nb0o\n"},
+		{`,x/boo/ s/o/0/g`, "foo boo", "foo b00"},
+	})
+}
+
+func TestMark(t *testing.T) {
+	testedit(t, [][3]string{
+		{"2k\n'd", "a\nb\nc\n", "a\nc\n"},
+		{"3k\n1d\n'd", "a\nb\nc\n", "b\nc\n"},
+		{"/b/k\n,x/a/ c/A/\n' c/B/", "a b a", "A B A"},
+		{"'d", "a\nb\n", "a\nb\n"},
+	})
+}
+
+func TestChain(t *testing.T) {
+	testedit(t, [][3]string{
+		{`1d 2d`, "a\nb\nc\n", "b\n"},
+		{`2k ,d`, "a\nb\nc\n", ""},
+		{`2k ,s/b/B/g 'd`, "a\nb\nc\n", "a\nc\n"},
+		{`2 i/>/ a/</`, "a\nb\nc\n", "a\n><b\nc\n"},
+		{`,x/b/ c/B/ a/!/`, "abc abc", "aB!c aB!c"},
+		{`,x/b/ c/B/ d`, "abc abc", "ac ac"},
+		{`,x/a/ g/a/ c/A/`, "ab", "Ab"},
+		{`3d`, "a\nb\nc\n", "a\nb\n"},
+		{`2d`, "a\nb", "a\n"},
+		{`1d`, "ab", ""},
+	})
+}
+
+func TestE(t *testing.T) {
+	dir, err := ioutil.TempDir("", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "e.txt")
+	if err := ioutil.WriteFile(name, []byte("new\ntext\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testedit(t, [][3]string{
+		{"e " + name, "old\n", "new\ntext\n"},
+		{"e " + name + "\n,s/new/old/", "", "old\ntext\n"},
+	})
+
+	defer func() { status = 0 }()
+	have, err := edit("e "+filepath.Join(dir, "nosuch"), "old\n")
+	if err != nil || have != "old\n" || status != 1 {
+		t.Logf("e nosuch: have %q, %v, status %d", have, err, status)
+		t.Fail()
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var names []string
+	for _, name := range []string{"a.go", "b.txt", "c.go"} {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte("old\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	var buf bytes.Buffer
+	out = bufio.NewWriter(&buf)
+	defer func() { out = bufio.NewWriter(os.Stdout) }()
+	files = nil
+	defer func() { files = nil }()
+	if !load(names...) {
+		t.Fatal("load failed")
+	}
+	for _, line := range []string{
+		`X/\.go$/ f`,
+		`Y/\.go$/ f`,
+		`X/a\.go$/ ,c/new\n/`,
+		`w`,
+	} {
+		cmd, err := Cmdparse(line)
+		if err != nil {
+			t.Fatalf("%q: %s", line, err)
+		}
+		run(cmd)
+	}
+	out.Flush()
+	want := names[0] + "\n" + names[2] + "\n" + names[1] + "\n"
+	if have := buf.String(); have != want {
+		t.Logf("f: have %q, want %q", have, want)
+		t.Fail()
+	}
+	for i, want := range []string{"new\n", "old\n", "old\n"} {
+		data, err := ioutil.ReadFile(names[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Logf("w: %s: have %q, want %q", names[i], data, want)
+			t.Fail()
+		}
+	}
+	if fi, err := os.Stat(names[0]); err != nil || fi.Mode().Perm() != 0600 {
+		t.Logf("w: %s: mode changed: %v %v", names[0], fi.Mode(), err)
+		t.Fail()
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(name, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files = nil
+	defer func() { files = nil }()
+	if load(name, filepath.Join(dir, "nosuch")) {
+		t.Logf("load: missing file not reported")
+		t.Fail()
+	}
+	if len(files) != 1 || files[0].(*Win).Path != name {
+		t.Logf("load: have %d files, want %s", len(files), name)
+		t.Fail()
+	}
+}
+
+func TestStream(t *testing.T) {
+	for _, v := range [][3]string{
+		{`,s/^(\S+) (\S+)/\2 \1/`, "a b c\nd e\n", "b a c\ne d\n"},
+		{`1d`, "one\ntwo\nthree", ""},
+		{`,x/o/ c/0/`, "foo\nbar\nboo", "f00\nbar\nb00"},
+		{`,g/bar/ d`, "foo\nbar\nboo\n", "foo\nboo\n"},
+		{`,d`, "", ""},
+	} {
+		var script []*Command
+		for _, line := range splitlines(v[0]) {
+			cmd, err := Cmdparse(line)
+			if err != nil {
+				t.Fatalf("%q: %s", line, err)
+			}
+			script = append(script, cmd)
+		}
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		if err := stream(script, w, strings.NewReader(v[1])); err != nil {
+			t.Fatal(err)
+		}
+		w.Flush()
+		if have := buf.String(); have != v[2] {
+			t.Logf("%q on %q: have %q, want %q", v[0], v[1], have, v[2])
+			t.Fail()
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, script := range []string{
+		``,
+		`,z`,
+		`,s/(/x/`,
+		`,s/o/0`,
+		`,s`,
+		`,s1`,
+		`,sa/o/0/`,
+		`,x/(/ d`,
+		`,g/(/ d`,
+		`,v/(/ d`,
+		`X/(/ f`,
+		`2`,
+		`,d X/a/ f`,
+	} {
+		if _, err := Cmdparse(script); err == nil {
+			t.Logf("%q: parsed without error", script)
+			t.Fail()
+		}
+	}
+}